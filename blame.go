@@ -0,0 +1,526 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+type BlameOptions struct {
+	// IgnoreRevs are commits whose changes are attributed to the most
+	// similar lines they replaced, like git blame --ignore-rev. Lines
+	// which are like none of them stay with the ignored commit. Ids which
+	// do not name a commit are skipped.
+	IgnoreRevs []SHA1
+}
+
+// Blame is the commit which last changed each line of a file.
+type Blame struct {
+	Path    string
+	Lines   []*BlameLine
+	entries []*blameEntry
+}
+
+// BlameLine is the origin of a line. OrigLine is the number of the line,
+// from 1, in the file at Path in Commit, which differs from the blamed
+// path when the file has been renamed since.
+type BlameLine struct {
+	Commit   *Commit
+	Author   *User
+	Path     string
+	OrigLine int
+	Data     []byte
+	// Ignored is set for a line passed on by an ignored commit, and
+	// Unblamable for a line of an ignored commit which could not be.
+	Ignored    bool
+	Unblamable bool
+}
+
+// blameOrigin is a file in a commit, which the suspects are lines of.
+type blameOrigin struct {
+	commit   *Commit
+	path     string
+	mode     int
+	id       SHA1
+	data     []byte
+	lines    [][]byte
+	read     bool
+	suspects []*blameEntry
+	previous *blameOrigin
+	guilty   bool
+}
+
+// blameEntry is a run of n lines starting at lno in the blamed file and
+// at slno in the file of the suspect, both from 0.
+type blameEntry struct {
+	lno, slno, n int
+	suspect      *blameOrigin
+	ignored      bool
+	unblamable   bool
+}
+
+type blamer struct {
+	repo    *Repository
+	ignore  map[SHA1]bool
+	commits map[SHA1]*Commit
+	origins map[SHA1][]*blameOrigin
+	queue   *commitQueue
+	guilty  []*blameEntry
+}
+
+// Blame attributes each line of the file at path in c to the commit
+// which introduced it like git blame. The history is walked through all
+// the parents of merges, and a file which did not exist in a parent is
+// looked for among the files deleted by the commit which are similar
+// enough to it.
+func (r *Repository) Blame(c *Commit, path string, opts BlameOptions) (*Blame, error) {
+	if err := r.Resolve(c); err != nil {
+		return nil, err
+	}
+	path = strings.Trim(path, "/")
+	e, err := c.Tree.entry(strings.Split(path, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if modeType(e.Mode) != "blob" {
+		return nil, ErrUnknownFormat
+	}
+
+	b := &blamer{
+		repo:    r,
+		ignore:  make(map[SHA1]bool),
+		commits: map[SHA1]*Commit{c.id: c},
+		origins: make(map[SHA1][]*blameOrigin),
+		queue:   newCommitQueue(commitDate),
+	}
+	for _, id := range opts.IgnoreRevs {
+		if ic, err := r.commitOf(id); err == nil {
+			b.ignore[ic.id] = true
+		}
+	}
+	final := b.origin(c, path)
+	final.mode, final.id = e.Mode, e.Object.SHA1()
+	if err := b.read(final); err != nil {
+		return nil, err
+	}
+	lines := final.lines
+	if len(lines) > 0 {
+		b.queue.push(c)
+		final.suspects = []*blameEntry{{n: len(lines), suspect: final}}
+	}
+
+	for b.queue.Len() > 0 {
+		commit := b.queue.pop()
+		for _, o := range b.origins[commit.id] {
+			if len(o.suspects) == 0 {
+				continue
+			}
+			if err := b.pass(o); err != nil {
+				return nil, err
+			}
+			// the lines left have been introduced by the commit
+			if len(o.suspects) > 0 {
+				o.guilty = true
+				b.guilty = append(b.guilty, o.suspects...)
+				o.suspects = nil
+			}
+		}
+	}
+
+	blame := &Blame{Path: path, entries: coalesceBlame(b.guilty)}
+	for _, e := range blame.entries {
+		for i := 0; i < e.n; i++ {
+			blame.Lines = append(blame.Lines, &BlameLine{
+				Commit:     e.suspect.commit,
+				Author:     e.suspect.commit.Author,
+				Path:       e.suspect.path,
+				OrigLine:   e.slno + i + 1,
+				Data:       lines[e.lno+i],
+				Ignored:    e.ignored,
+				Unblamable: e.unblamable,
+			})
+		}
+	}
+	return blame, nil
+}
+
+// commit returns the commit of id resolved once for the whole walk.
+func (b *blamer) commit(c *Commit) (*Commit, error) {
+	if known, ok := b.commits[c.id]; ok {
+		return known, nil
+	}
+	if err := b.repo.Resolve(c); err != nil {
+		return nil, err
+	}
+	b.commits[c.id] = c
+	return c, nil
+}
+
+func (b *blamer) origin(c *Commit, path string) *blameOrigin {
+	for _, o := range b.origins[c.id] {
+		if o.path == path {
+			return o
+		}
+	}
+	o := &blameOrigin{commit: c, path: path}
+	b.origins[c.id] = append(b.origins[c.id], o)
+	return o
+}
+
+func (b *blamer) read(o *blameOrigin) error {
+	if o.read {
+		return nil
+	}
+	obj, err := b.repo.Object(o.id)
+	if err != nil {
+		return err
+	}
+	blob, ok := obj.(*Blob)
+	if !ok {
+		return ErrUnknownFormat
+	}
+	o.data, o.lines, o.read = blob.Data, splitLines(blob.Data), true
+	return nil
+}
+
+// give hands entries over to the origin o, queueing its commit unless it
+// already has suspects waiting.
+func (b *blamer) give(o *blameOrigin, entries []*blameEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	if len(o.suspects) == 0 {
+		b.queue.push(o.commit)
+	}
+	o.suspects = append(o.suspects, entries...)
+}
+
+// pass hands the suspects of o which are unchanged in the parents over to
+// them. A parent with the same file takes all of them, otherwise they are
+// passed to each parent in turn. The lines which an ignored commit
+// changed are then passed to the most similar lines of the parents.
+func (b *blamer) pass(o *blameOrigin) error {
+	parents := make([]*blameOrigin, len(o.commit.Parents))
+	for rename := 0; rename < 2; rename++ {
+		for i, p := range o.commit.Parents {
+			if parents[i] != nil {
+				continue
+			}
+			p, err := b.commit(p)
+			if err != nil {
+				return err
+			}
+			var po *blameOrigin
+			if rename == 0 {
+				po, err = b.findOrigin(p, o)
+			} else {
+				po, err = b.findRename(p, o)
+			}
+			if err != nil {
+				return err
+			}
+			if po == nil {
+				continue
+			}
+			if po.id == o.id {
+				for _, e := range o.suspects {
+					e.suspect = po
+				}
+				b.give(po, o.suspects)
+				o.suspects = nil
+				return nil
+			}
+			same := false
+			for _, q := range parents[:i] {
+				if q != nil && q.id == po.id {
+					same = true
+					break
+				}
+			}
+			if !same {
+				parents[i] = po
+			}
+		}
+	}
+
+	for _, ignoring := range []bool{false, true} {
+		if ignoring && !b.ignore[o.commit.id] {
+			break
+		}
+		for _, po := range parents {
+			if po == nil {
+				continue
+			}
+			if o.previous == nil {
+				o.previous = po
+			}
+			if err := b.passToParent(o, po, ignoring); err != nil {
+				return err
+			}
+			if len(o.suspects) == 0 {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// findOrigin returns the file of the same path in the parent p unless it
+// is missing there or of another type.
+func (b *blamer) findOrigin(p *Commit, o *blameOrigin) (*blameOrigin, error) {
+	for _, po := range b.origins[p.id] {
+		if po.path == o.path {
+			return po, nil
+		}
+	}
+	e, err := p.Tree.entry(strings.Split(o.path, "/"))
+	if err == ErrObjectNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if e.Mode&0170000 != o.mode&0170000 {
+		return nil, nil
+	}
+	po := b.origin(p, o.path)
+	po.mode, po.id = e.Mode, e.Object.SHA1()
+	return po, nil
+}
+
+// findRename returns the file of the parent p which the file of o has
+// been renamed or copied from, detecting renames among the files deleted
+// by the commit.
+func (b *blamer) findRename(p *Commit, o *blameOrigin) (*blameOrigin, error) {
+	d := &treeDiff{repo: b.repo, spec: newPathspec(nil), zero: b.repo.Format.zero()}
+	if err := d.diff("", p.Tree, o.commit.Tree); err != nil {
+		return nil, err
+	}
+	// only the followed file is a destination
+	var changes []*Change
+	added := false
+	for _, c := range d.changes {
+		switch {
+		case c.Type == ChangeDelete:
+			changes = append(changes, c)
+		case c.Type == ChangeAdd && c.NewPath == o.path:
+			changes = append(changes, c)
+			added = true
+		}
+	}
+	if !added {
+		return nil, nil
+	}
+	d.changes = changes
+	if err := d.detectRenames(DiffOptions{DetectRenames: true}); err != nil {
+		return nil, err
+	}
+	for _, c := range d.changes {
+		if (c.Type == ChangeRename || c.Type == ChangeCopy) && c.NewPath == o.path {
+			po := b.origin(p, c.OldPath)
+			po.mode, po.id = c.OldMode, c.OldID
+			return po, nil
+		}
+	}
+	return nil, nil
+}
+
+// passToParent diffs the file of o against that of the parent po, and
+// hands over the suspects in the lines which are unchanged. If ignoring,
+// the changed lines are also handed over to the most similar lines they
+// replaced.
+func (b *blamer) passToParent(o, po *blameOrigin, ignoring bool) error {
+	if err := b.read(o); err != nil {
+		return err
+	}
+	if err := b.read(po); err != nil {
+		return err
+	}
+	pdata, tdata := trimCommonTail(po.data, o.data)
+	hunks := newLineDiff(pdata, tdata, DiffMyers).changes()
+
+	// the lines of o are cut into the runs which are the same in po, at an
+	// offset, and the hunks which differ
+	var regions []blameRegion
+	pos, offset := 0, 0
+	for i, h := range hunks {
+		regions = append(regions,
+			blameRegion{start: pos, end: h.NewStart, offset: h.OldStart - h.NewStart, hunk: -1},
+			blameRegion{start: h.NewStart, end: h.NewStart + h.NewLines, hunk: i})
+		pos = h.NewStart + h.NewLines
+		offset = h.OldStart + h.OldLines - pos
+	}
+	regions = append(regions, blameRegion{start: pos, end: len(o.lines), offset: offset, hunk: -1})
+
+	// the lines of an ignored commit are matched hunk by hunk, each taking
+	// away what it matches from the old lines
+	var guesses [][]int
+	if ignoring {
+		fa, fb := blameFingerprints(po.lines), blameFingerprints(o.lines)
+		guesses = make([][]int, len(hunks))
+		for i, h := range hunks {
+			guesses[i] = guessBlameLines(fa, fb, h)
+		}
+	}
+
+	var kept, passed []*blameEntry
+	for _, e := range o.suspects {
+		end := e.slno + e.n
+		i := sort.Search(len(regions), func(i int) bool { return regions[i].end > e.slno })
+		for ; i < len(regions) && regions[i].start < end; i++ {
+			rg := regions[i]
+			n := *e
+			if rg.start > n.slno {
+				n.slno = rg.start
+			}
+			n.lno += n.slno - e.slno
+			n.n = end - n.slno
+			if rg.end < end {
+				n.n = rg.end - n.slno
+			}
+			if n.n <= 0 {
+				continue
+			}
+			switch {
+			case rg.hunk < 0:
+				n.suspect, n.slno = po, n.slno+rg.offset
+				passed = append(passed, &n)
+			case !ignoring:
+				kept = append(kept, &n)
+			default:
+				k, p := ignoreBlameEntry(&n, po, guesses[rg.hunk][n.slno-rg.start:])
+				kept = append(kept, k...)
+				passed = append(passed, p...)
+			}
+		}
+	}
+	o.suspects = kept
+	b.give(po, passed)
+	return nil
+}
+
+type blameRegion struct {
+	start, end int
+	offset     int
+	hunk       int
+}
+
+// ignoreBlameEntry splits e, which lies in a hunk changed by an ignored
+// commit, into the runs of lines guessed to come from consecutive lines of
+// po, and the runs of lines which are like none and stay unblamable.
+func ignoreBlameEntry(e *blameEntry, po *blameOrigin, guess []int) (kept, passed []*blameEntry) {
+	for i := 0; i < e.n; {
+		j := i + 1
+		for j < e.n && (guess[j] >= 0) == (guess[i] >= 0) && (guess[i] < 0 || guess[j] == guess[j-1]+1) {
+			j++
+		}
+		n := *e
+		n.lno, n.slno, n.n = e.lno+i, e.slno+i, j-i
+		if guess[i] >= 0 {
+			n.suspect, n.slno, n.ignored = po, guess[i], true
+			passed = append(passed, &n)
+		} else {
+			n.unblamable = true
+			kept = append(kept, &n)
+		}
+		i = j
+	}
+	return
+}
+
+// coalesceBlame sorts the entries by line and joins the adjacent ones
+// which continue each other.
+func coalesceBlame(entries []*blameEntry) []*blameEntry {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].lno < entries[j].lno })
+	var out []*blameEntry
+	for _, e := range entries {
+		if len(out) > 0 {
+			last := out[len(out)-1]
+			if last.suspect == e.suspect && last.slno+last.n == e.slno && last.lno+last.n == e.lno &&
+				last.ignored == e.ignored && last.unblamable == e.unblamable {
+				last.n += e.n
+				continue
+			}
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// WritePorcelain writes the blame in the format of git blame --porcelain,
+// or --line-porcelain if every line should repeat the commit information.
+// Root commits are marked as boundaries as git does by default.
+func (b *Blame) WritePorcelain(w io.Writer, everyLine bool) error {
+	// commits blamed under several paths always name the file
+	paths := make(map[SHA1]map[string]bool)
+	for _, e := range b.entries {
+		id := e.suspect.commit.id
+		if paths[id] == nil {
+			paths[id] = make(map[string]bool)
+		}
+		paths[id][e.suspect.path] = true
+	}
+	shown := make(map[SHA1]bool)
+	details := func(bw *bufio.Writer, o *blameOrigin) {
+		c := o.commit
+		if everyLine || !shown[c.id] {
+			shown[c.id] = true
+			writeBlameUser(bw, "author", c.Author)
+			writeBlameUser(bw, "committer", c.Committer)
+			fmt.Fprintf(bw, "summary %s\n", commitSubject(c.Data))
+			if c.IsRoot() {
+				bw.WriteString("boundary\n")
+			}
+		} else if len(paths[c.id]) < 2 {
+			return
+		}
+		if p := o.previous; p != nil {
+			fmt.Fprintf(bw, "previous %s %s\n", p.commit.id, quotePath(p.path))
+		}
+		fmt.Fprintf(bw, "filename %s\n", quotePath(o.path))
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, e := range b.entries {
+		id := e.suspect.commit.id
+		for i := 0; i < e.n; i++ {
+			if i == 0 {
+				fmt.Fprintf(bw, "%s %d %d %d\n", id, e.slno+1, e.lno+1, e.n)
+				details(bw, e.suspect)
+			} else {
+				fmt.Fprintf(bw, "%s %d %d\n", id, e.slno+i+1, e.lno+i+1)
+				if everyLine {
+					details(bw, e.suspect)
+				}
+			}
+			line := b.Lines[e.lno+i].Data
+			bw.WriteByte('\t')
+			bw.Write(line)
+			if len(line) > 0 && line[len(line)-1] != '\n' {
+				bw.WriteByte('\n')
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+func writeBlameUser(w *bufio.Writer, role string, u *User) {
+	fmt.Fprintf(w, "%s %s\n%s-mail <%s>\n%s-time %d\n%s-tz %s\n",
+		role, u.Name, role, u.Email, role, u.Date.Unix(), role, u.Date.Format("-0700"))
+}
+
+// commitSubject returns the first paragraph of a commit message joined
+// into a line.
+func commitSubject(msg []byte) string {
+	var lines []string
+	for _, line := range bytes.Split(msg, []byte("\n")) {
+		line = bytes.TrimRight(line, " \t\r")
+		if len(line) == 0 {
+			break
+		}
+		lines = append(lines, string(line))
+	}
+	return strings.Join(lines, " ")
+}
@@ -0,0 +1,266 @@
+package git
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+const (
+	// fuzzySearchDistance is how many lines around the line at the same
+	// relative position are compared when matching lines.
+	fuzzySearchDistance = 10
+
+	certaintyNotCalculated = -1
+	certainNothingMatches  = -2
+)
+
+// ReadBlameIgnoreRevs reads the commits to ignore from r in the format of
+// .git-blame-ignore-revs, a full object id per line where '#' starts a
+// comment.
+func ReadBlameIgnoreRevs(r io.Reader) ([]SHA1, error) {
+	var ids []SHA1
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		id, err := NewSHA1(line)
+		if err != nil {
+			return nil, ErrInvalidObjectID
+		}
+		ids = append(ids, id)
+	}
+	return ids, s.Err()
+}
+
+// lineFingerprint counts the pairs of adjacent characters of a line, in
+// lower case and with spaces as zeros.
+type lineFingerprint map[uint16]int
+
+func newLineFingerprint(line []byte) lineFingerprint {
+	f := make(lineFingerprint)
+	var c0 uint16
+	for i := 0; i <= len(line); i++ {
+		var c1 uint16
+		if i < len(line) && strings.IndexByte(" \t\n\r", line[i]) == -1 {
+			c := line[i]
+			if c >= 'A' && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			c1 = uint16(c)
+		}
+		if h := c0 | c1<<8; h != 0 {
+			f[h]++
+		}
+		c0 = c1
+	}
+	return f
+}
+
+func (f lineFingerprint) similarity(g lineFingerprint) int {
+	n := 0
+	for h, c := range g {
+		if d := f[h]; d < c {
+			n += d
+		} else {
+			n += c
+		}
+	}
+	return n
+}
+
+func (f lineFingerprint) subtract(g lineFingerprint) {
+	for h, c := range g {
+		if d, ok := f[h]; ok {
+			if d <= c {
+				delete(f, h)
+			} else {
+				f[h] = d - c
+			}
+		}
+	}
+}
+
+// guessBlameLines matches each new line of a hunk changed by an ignored
+// commit with the most similar old line like git, or -1 if there is none.
+// The line matched with most certainty splits the rest of the hunk, which
+// keeps the matches in order, and lines are only compared with the old
+// lines near the same relative position. A line left unmatched is looked
+// for in the whole old file. The fingerprints of the old lines lose the
+// parts which have been matched.
+func guessBlameLines(fa, fb []lineFingerprint, h LineChange) []int {
+	result := make([]int, h.NewLines)
+	for i := range result {
+		result[i] = -1
+	}
+	if h.OldLines > 0 {
+		m := &fuzzyMatcher{lengthA: h.OldLines, lengthB: h.NewLines, maxA: fuzzySearchDistance}
+		if m.maxA >= m.lengthA {
+			m.maxA = m.lengthA - 1
+		}
+		m.maxB = ((2*m.maxA+1)*m.lengthB - 1) / m.lengthA
+		sims := make([]int, m.lengthB*(2*m.maxA+1))
+		for i := range sims {
+			sims[i] = -1
+		}
+		certs := make([]int, m.lengthB)
+		second := make([]int, m.lengthB)
+		for i := range certs {
+			certs[i], second[i] = certaintyNotCalculated, -1
+		}
+		m.match(0, 0, m.lengthA, m.lengthB, fa[h.OldStart:h.OldStart+h.OldLines], fb[h.NewStart:h.NewStart+h.NewLines], sims, certs, second, result)
+	}
+	for i, r := range result {
+		if r >= 0 {
+			result[i] = h.OldStart + r
+		} else {
+			result[i] = scanBlameLines(fa, fb[h.NewStart+i], h.NewStart+i)
+		}
+	}
+	return result
+}
+
+// scanBlameLines returns the old line most similar to the new line at
+// index, if similar enough, preferring the nearest one.
+func scanBlameLines(fa []lineFingerprint, f lineFingerprint, index int) int {
+	const threshold = 10
+	best, bestSim := -1, threshold
+	for i := range fa {
+		sim := fa[i].similarity(f)
+		if sim < bestSim {
+			continue
+		}
+		if sim == bestSim && best != -1 && abs(best-index) < abs(i-index) {
+			continue
+		}
+		best, bestSim = i, sim
+	}
+	return best
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// fuzzyMatcher holds the parameters of matching the lines of a hunk, with
+// the lines numbered from the start of the hunk.
+type fuzzyMatcher struct {
+	lengthA, lengthB int
+	maxA, maxB       int
+}
+
+// closest returns the line of A at the same relative position as line l
+// of B.
+func (m *fuzzyMatcher) closest(l int) int {
+	return (l*2 + 1) * m.lengthA / (m.lengthB * 2)
+}
+
+// match finds the matches of the lengthB lines of B from startB among the
+// lengthA lines of A from startA. The slices start at these lines, and
+// sims has a row of 2*maxA+1 similarities around the closest line of A for
+// each line of B.
+func (m *fuzzyMatcher) match(startA, startB, lengthA, lengthB int, fa, fb []lineFingerprint, sims, certs, second, result []int) {
+	best, bestCertainty := -1, -1
+	for i := 0; i < lengthB; i++ {
+		m.findBest(startA, lengthA, startB, i, fa, fb, sims, certs, second, result)
+		if certs[i] > bestCertainty {
+			best, bestCertainty = i, certs[i]
+		}
+	}
+	if best == -1 {
+		return
+	}
+	lineA := result[best]
+
+	// the parts of the line of A taken by the best match cannot match
+	// other lines, and the matches around it which contradict its order
+	// are recalculated
+	fa[lineA-startA].subtract(fb[best])
+	invMin, invMax := best-m.maxB, best+m.maxB+1
+	if invMin < 0 {
+		invMin = 0
+	}
+	if invMax > lengthB {
+		invMax = lengthB
+	}
+	row := 2*m.maxA + 1
+	for i := invMin; i < invMax; i++ {
+		closest := m.closest(i+startB) - startA
+		if abs(lineA-startA-closest) > m.maxA {
+			continue
+		}
+		sims[lineA-startA-closest+m.maxA+i*row] = -1
+	}
+	for i := best - 1; i >= invMin; i-- {
+		if certs[i] >= 0 && (result[i] >= lineA || second[i] >= lineA) {
+			certs[i] = certaintyNotCalculated
+		}
+	}
+	for i := best + 1; i < invMax; i++ {
+		if certs[i] >= 0 && (result[i] <= lineA || second[i] <= lineA) {
+			certs[i] = certaintyNotCalculated
+		}
+	}
+
+	if best > 0 {
+		m.match(startA, startB, lineA+1-startA, best, fa, fb, sims, certs, second, result)
+	}
+	if best+1 < lengthB {
+		off := best + 1
+		m.match(lineA, startB+off, lengthA+startA-lineA, lengthB-off,
+			fa[lineA-startA:], fb[off:], sims[off*row:], certs[off:], second[off:], result[off:])
+	}
+}
+
+// findBest compares line b of B with the lines of A around its closest
+// one, and records how certain its best match is: twice its similarity
+// less that of the second best.
+func (m *fuzzyMatcher) findBest(startA, lengthA, startB, b int, fa, fb []lineFingerprint, sims, certs, second, result []int) {
+	if certs[b] != certaintyNotCalculated {
+		return
+	}
+	closest := m.closest(b+startB) - startA
+	from, to := closest-m.maxA, closest+m.maxA+1
+	if from < 0 {
+		from = 0
+	}
+	if to > lengthA {
+		to = lengthA
+	}
+	var bestSim, secondSim, bestIdx, secondIdx int
+	for i := from; i < to; i++ {
+		sim := &sims[i-closest+m.maxA+b*(2*m.maxA+1)]
+		if *sim == -1 {
+			// nearer lines win ties
+			*sim = fa[i].similarity(fb[b]) * (1000 - abs(i-closest))
+		}
+		if *sim > bestSim {
+			secondSim, secondIdx = bestSim, bestIdx
+			bestSim, bestIdx = *sim, i
+		} else if *sim > secondSim {
+			secondSim, secondIdx = *sim, i
+		}
+	}
+	if bestSim == 0 {
+		certs[b], result[b] = certainNothingMatches, -1
+		return
+	}
+	certs[b] = bestSim*2 - secondSim
+	result[b], second[b] = startA+bestIdx, startA+secondIdx
+}
+
+func blameFingerprints(lines [][]byte) []lineFingerprint {
+	f := make([]lineFingerprint, len(lines))
+	for i, line := range lines {
+		f[i] = newLineFingerprint(line)
+	}
+	return f
+}
@@ -38,7 +38,11 @@ func (c *Commit) Parse(data []byte) error {
 	if value, data, err = readKV(data, "tree "); err != nil {
 		return err
 	}
-	tree := newTree(SHA1FromString(string(value)), c.repo)
+	id, err := NewSHA1(string(value))
+	if err != nil {
+		return err
+	}
+	tree := newTree(id, c.repo)
 
 	for {
 		value, data, err = readKV(data, "parent ")
@@ -47,7 +51,10 @@ func (c *Commit) Parse(data []byte) error {
 		} else if err != nil {
 			return err
 		}
-		parents = append(parents, newCommit(SHA1FromString(string(value)), c.repo))
+		if id, err = NewSHA1(string(value)); err != nil {
+			return err
+		}
+		parents = append(parents, newCommit(id, c.repo))
 	}
 
 	if value, data, err = readKV(data, "author "); err != nil {
@@ -68,7 +75,9 @@ func (c *Commit) Parse(data []byte) error {
 	c.Parents = parents
 	c.Author = author
 	c.Committer = committer
-	c.Data = data[1:]
+	if len(data) > 0 {
+		c.Data = data[1:]
+	}
 	return nil
 }
 
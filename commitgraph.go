@@ -0,0 +1,319 @@
+package git
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"sort"
+)
+
+var commitGraphMagic = [4]byte{'C', 'G', 'P', 'H'}
+
+const (
+	commitGraphChunkOIDFanout   = 0x4f494446 // "OIDF"
+	commitGraphChunkOIDLookup   = 0x4f49444c // "OIDL"
+	commitGraphChunkCommitData  = 0x43444154 // "CDAT"
+	commitGraphChunkExtraEdges  = 0x45444745 // "EDGE"
+	commitGraphChunkBloomIndex  = 0x42494458 // "BIDX"
+	commitGraphChunkBloomData   = 0x42444154 // "BDAT"
+	commitGraphParentNone       = 0x70000000
+	commitGraphParentOctopus    = 0x80000000
+	commitGraphParentLast       = 0x80000000
+	commitGraphBloomHeaderBytes = 12
+)
+
+type CommitGraphHeader struct {
+	Magic       [4]byte
+	Version     uint8
+	HashVersion uint8
+	Chunks      uint8
+	BaseGraphs  uint8
+}
+
+type CommitGraph struct {
+	CommitGraphHeader
+	Format        ObjectFormat
+	Fanout        [256]uint32
+	Objects       []SHA1
+	BloomSettings *BloomFilterSettings
+	commits       []byte
+	edges         []byte
+	bloomIndex    []byte
+	bloomData     []byte
+}
+
+func OpenCommitGraph(path string) (*CommitGraph, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	g := new(CommitGraph)
+	err = g.Parse(data)
+	return g, err
+}
+
+func (g *CommitGraph) Parse(data []byte) error {
+	if err := binary.Read(bytes.NewReader(data), binary.BigEndian, &g.CommitGraphHeader); err != nil {
+		return err
+	}
+	if g.Magic != commitGraphMagic || g.Version != 1 || g.BaseGraphs != 0 {
+		return ErrUnknownFormat
+	}
+	switch g.HashVersion {
+	case 1:
+		g.Format = FormatSHA1
+	case 2:
+		g.Format = FormatSHA256
+	default:
+		return ErrUnknownFormat
+	}
+	size := g.Format.Size()
+
+	chunks := make(map[uint32][]byte)
+	table := data[8:]
+	if len(table) < (int(g.Chunks)+1)*12 {
+		return ErrUnknownFormat
+	}
+	for i := 0; i < int(g.Chunks); i++ {
+		id := binary.BigEndian.Uint32(table[i*12:])
+		start := binary.BigEndian.Uint64(table[i*12+4:])
+		end := binary.BigEndian.Uint64(table[(i+1)*12+4:])
+		if start > end || end > uint64(len(data)) {
+			return ErrUnknownFormat
+		}
+		chunks[id] = data[start:end]
+	}
+
+	fanout := chunks[commitGraphChunkOIDFanout]
+	if len(fanout) != 256*4 {
+		return ErrUnknownFormat
+	}
+	for i := range g.Fanout {
+		g.Fanout[i] = binary.BigEndian.Uint32(fanout[i*4:])
+		if i > 0 && g.Fanout[i] < g.Fanout[i-1] {
+			return ErrUnknownFormat
+		}
+	}
+
+	total := int(g.Fanout[255])
+	lookup := chunks[commitGraphChunkOIDLookup]
+	if len(lookup) != total*size {
+		return ErrUnknownFormat
+	}
+	g.Objects = make([]SHA1, total, total)
+	for i := range g.Objects {
+		g.Objects[i] = sha1FromBytes(lookup[i*size : (i+1)*size])
+	}
+
+	g.commits = chunks[commitGraphChunkCommitData]
+	if len(g.commits) != total*(size+16) {
+		return ErrUnknownFormat
+	}
+	g.edges = chunks[commitGraphChunkExtraEdges]
+
+	index, bloom := chunks[commitGraphChunkBloomIndex], chunks[commitGraphChunkBloomData]
+	if len(index) == total*4 && len(bloom) >= commitGraphBloomHeaderBytes {
+		g.BloomSettings = &BloomFilterSettings{
+			HashVersion:  binary.BigEndian.Uint32(bloom),
+			NumHashes:    binary.BigEndian.Uint32(bloom[4:]),
+			BitsPerEntry: binary.BigEndian.Uint32(bloom[8:]),
+		}
+		g.bloomIndex = index
+		g.bloomData = bloom[commitGraphBloomHeaderBytes:]
+	}
+	return nil
+}
+
+func (g *CommitGraph) position(id SHA1) (int, bool) {
+	lower := 0
+	if id.hash[0] != 0 {
+		lower = int(g.Fanout[int(id.hash[0])-1])
+	}
+	upper := int(g.Fanout[int(id.hash[0])])
+	entries := g.Objects[lower:upper]
+	x := sort.Search(len(entries), func(i int) bool {
+		return entries[i].Compare(id) >= 0
+	})
+	if x == len(entries) || entries[x] != id {
+		return 0, false
+	}
+	return lower + x, true
+}
+
+// Entry returns the commit id as recorded in the graph, or nil if it is
+// not there or its parents are out of range of a corrupt graph, when the
+// commit object has to be parsed instead.
+func (g *CommitGraph) Entry(id SHA1) *CommitGraphEntry {
+	pos, ok := g.position(id)
+	if !ok {
+		return nil
+	}
+	size := g.Format.Size()
+	data := g.commits[pos*(size+16):]
+	entry := &CommitGraphEntry{
+		ID:   id,
+		Tree: sha1FromBytes(data[:size]),
+	}
+	data = data[size:]
+
+	parent := func(n uint32) bool {
+		if int64(n) >= int64(len(g.Objects)) {
+			return false
+		}
+		entry.Parents = append(entry.Parents, g.Objects[n])
+		return true
+	}
+	parent1 := binary.BigEndian.Uint32(data)
+	parent2 := binary.BigEndian.Uint32(data[4:])
+	if parent1 != commitGraphParentNone && !parent(parent1) {
+		return nil
+	}
+	if parent2&commitGraphParentOctopus != 0 {
+		for i := int64(parent2 &^ commitGraphParentOctopus); ; i++ {
+			if i*4+4 > int64(len(g.edges)) {
+				return nil
+			}
+			edge := binary.BigEndian.Uint32(g.edges[i*4:])
+			if !parent(edge &^ commitGraphParentLast) {
+				return nil
+			}
+			if edge&commitGraphParentLast != 0 {
+				break
+			}
+		}
+	} else if parent2 != commitGraphParentNone && !parent(parent2) {
+		return nil
+	}
+
+	gen := binary.BigEndian.Uint32(data[8:])
+	entry.Generation = gen >> 2
+	entry.CommitTime = int64(gen&0x03)<<32 | int64(binary.BigEndian.Uint32(data[12:]))
+	return entry
+}
+
+// Generation returns the topological level of the commit id, which is
+// greater than that of any of its parents.
+func (g *CommitGraph) Generation(id SHA1) (uint32, bool) {
+	pos, ok := g.position(id)
+	if !ok {
+		return 0, false
+	}
+	size := g.Format.Size()
+	return binary.BigEndian.Uint32(g.commits[pos*(size+16)+size+8:]) >> 2, true
+}
+
+func (g *CommitGraph) BloomFilter(id SHA1) *BloomFilter {
+	if g.BloomSettings == nil {
+		return nil
+	}
+	pos, ok := g.position(id)
+	if !ok {
+		return nil
+	}
+	var start uint32
+	if pos > 0 {
+		start = binary.BigEndian.Uint32(g.bloomIndex[(pos-1)*4:])
+	}
+	end := binary.BigEndian.Uint32(g.bloomIndex[pos*4:])
+	if start > end || int(end) > len(g.bloomData) {
+		return nil
+	}
+	return &BloomFilter{
+		Data:     g.bloomData[start:end],
+		settings: g.BloomSettings,
+	}
+}
+
+type CommitGraphEntry struct {
+	ID         SHA1
+	Tree       SHA1
+	Parents    []SHA1
+	Generation uint32
+	CommitTime int64
+}
+
+type BloomFilterSettings struct {
+	HashVersion  uint32
+	NumHashes    uint32
+	BitsPerEntry uint32
+}
+
+type BloomFilter struct {
+	Data     []byte
+	settings *BloomFilterSettings
+}
+
+// MaybeContains reports whether path may have been changed by the commit.
+// The second return value is false if the filter cannot answer the query,
+// e.g. the filter is empty because too many paths were changed.
+func (f *BloomFilter) MaybeContains(path string) (bool, bool) {
+	bits := uint64(len(f.Data)) * 8
+	if bits == 0 || (f.settings.HashVersion != 1 && f.settings.HashVersion != 2) {
+		return false, false
+	}
+	signed := f.settings.HashVersion == 1
+	hash0 := murmur3([]byte(path), 0x293ae76f, signed)
+	hash1 := murmur3([]byte(path), 0x7e646e2c, signed)
+	for i := uint32(0); i < f.settings.NumHashes; i++ {
+		pos := uint64(hash0+i*hash1) % bits
+		if f.Data[pos/8]&(1<<(pos%8)) == 0 {
+			return false, true
+		}
+	}
+	return true, true
+}
+
+// murmur3 is the 32-bit MurmurHash3 used by git's changed-path filters.
+// Version 1 filters were computed with bytes treated as signed chars.
+func murmur3(data []byte, seed uint32, signed bool) uint32 {
+	const (
+		c1 = 0xcc9e2d51
+		c2 = 0x1b873593
+	)
+	word := func(b byte) uint32 {
+		if signed {
+			return uint32(int32(int8(b)))
+		}
+		return uint32(b)
+	}
+	rotl := func(x uint32, r uint) uint32 {
+		return x<<r | x>>(32-r)
+	}
+
+	h := seed
+	n := len(data) / 4
+	for i := 0; i < n; i++ {
+		b := data[i*4:]
+		k := word(b[0]) | word(b[1])<<8 | word(b[2])<<16 | word(b[3])<<24
+		k *= c1
+		k = rotl(k, 15)
+		k *= c2
+		h ^= k
+		h = rotl(h, 13)*5 + 0xe6546b64
+	}
+
+	var k uint32
+	tail := data[n*4:]
+	switch len(tail) {
+	case 3:
+		k ^= word(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= word(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= word(tail[0])
+		k *= c1
+		k = rotl(k, 15)
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(len(data))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
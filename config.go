@@ -0,0 +1,206 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+var ErrInvalidConfig = errors.New("Invalid config")
+
+type Config struct {
+	entries []configEntry
+}
+
+type configEntry struct {
+	name  string
+	value string
+}
+
+func OpenConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := new(Config)
+	err = c.Parse(f)
+	return c, err
+}
+
+// Get returns the last value of the variable such as "core.bare" or
+// "branch.main.remote". Section and key names are case-insensitive.
+func (c *Config) Get(name string) string {
+	values := c.GetAll(name)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
+
+func (c *Config) GetAll(name string) []string {
+	name = normalizeConfigName(name)
+	var out []string
+	for _, e := range c.entries {
+		if e.name == name {
+			out = append(out, e.value)
+		}
+	}
+	return out
+}
+
+func (c *Config) Bool(name string, def bool) bool {
+	values := c.GetAll(name)
+	if len(values) == 0 {
+		return def
+	}
+	switch strings.ToLower(values[len(values)-1]) {
+	case "true", "yes", "on", "1":
+		return true
+	case "false", "no", "off", "0", "":
+		return false
+	}
+	return def
+}
+
+func (c *Config) Parse(r io.Reader) error {
+	var section string
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		for strings.HasSuffix(strings.TrimRight(line, "\r\n"), "\\") && err == nil {
+			var next string
+			next, err = br.ReadString('\n')
+			if err != nil && err != io.EOF {
+				return err
+			}
+			line = strings.TrimSuffix(strings.TrimRight(line, "\r\n"), "\\") + next
+		}
+
+		s := strings.TrimSpace(line)
+		switch {
+		case s == "" || s[0] == '#' || s[0] == ';':
+		case s[0] == '[':
+			var rest string
+			if section, rest, err = parseConfigSection(s); err != nil {
+				return err
+			}
+			if rest != "" {
+				e, err := parseConfigEntry(section, rest)
+				if err != nil {
+					return err
+				}
+				c.entries = append(c.entries, e)
+			}
+		default:
+			if section == "" {
+				return ErrInvalidConfig
+			}
+			e, err := parseConfigEntry(section, s)
+			if err != nil {
+				return err
+			}
+			c.entries = append(c.entries, e)
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+func parseConfigSection(s string) (string, string, error) {
+	end := strings.IndexByte(s, ']')
+	if end == -1 {
+		return "", "", ErrInvalidConfig
+	}
+	header, rest := s[1:end], strings.TrimSpace(s[end+1:])
+	if pos := strings.IndexByte(header, ' '); pos != -1 {
+		sub := strings.TrimSpace(header[pos+1:])
+		if len(sub) < 2 || sub[0] != '"' || sub[len(sub)-1] != '"' {
+			return "", "", ErrInvalidConfig
+		}
+		sub = strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(sub[1 : len(sub)-1])
+		return strings.ToLower(header[:pos]) + "." + sub, rest, nil
+	}
+	// deprecated [section.subsection] syntax
+	return strings.ToLower(header), rest, nil
+}
+
+func parseConfigEntry(section, s string) (configEntry, error) {
+	key, value := s, ""
+	implicit := true
+	if pos := strings.IndexByte(s, '='); pos != -1 {
+		key, value = s[:pos], s[pos+1:]
+		implicit = false
+	}
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return configEntry{}, ErrInvalidConfig
+	}
+	e := configEntry{name: section + "." + strings.ToLower(key)}
+	if implicit {
+		e.value = "true"
+		return e, nil
+	}
+
+	var (
+		buf    bytes.Buffer
+		quoted bool
+		space  int
+	)
+	value = strings.TrimSpace(value)
+	for i := 0; i < len(value); i++ {
+		ch := value[i]
+		switch {
+		case ch == '"':
+			quoted = !quoted
+			continue
+		case ch == '\\' && i+1 < len(value):
+			i++
+			switch value[i] {
+			case 'n':
+				ch = '\n'
+			case 't':
+				ch = '\t'
+			case 'b':
+				ch = '\b'
+			default:
+				ch = value[i]
+			}
+		case !quoted && (ch == '#' || ch == ';'):
+			i = len(value)
+			continue
+		case !quoted && (ch == ' ' || ch == '\t'):
+			space++
+			continue
+		}
+		if space > 0 {
+			if buf.Len() > 0 {
+				buf.WriteString(strings.Repeat(" ", space))
+			}
+			space = 0
+		}
+		buf.WriteByte(ch)
+	}
+	if quoted {
+		return configEntry{}, ErrInvalidConfig
+	}
+	e.value = buf.String()
+	return e, nil
+}
+
+func normalizeConfigName(name string) string {
+	first, last := strings.IndexByte(name, '.'), strings.LastIndexByte(name, '.')
+	if first == -1 {
+		return strings.ToLower(name)
+	}
+	return strings.ToLower(name[:first]) + name[first:last] + strings.ToLower(name[last:])
+}
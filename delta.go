@@ -106,3 +106,113 @@ func deltaHeaderSize(br *bufio.Reader) (int, error) {
 	}
 	return size, nil
 }
+
+const (
+	deltaBlockSize = 16
+	deltaMaxCopy   = 0x10000
+	deltaMaxInsert = 0x7f
+)
+
+// createDelta encodes dst as a delta against src. It returns nil if the
+// delta would be larger than maxSize.
+func createDelta(src, dst []byte, maxSize int) []byte {
+	if maxSize <= 0 {
+		return nil
+	}
+	index := make(map[string][]int)
+	for i := 0; i+deltaBlockSize <= len(src); i += deltaBlockSize {
+		key := string(src[i : i+deltaBlockSize])
+		if len(index[key]) < 64 {
+			index[key] = append(index[key], i)
+		}
+	}
+
+	out := appendDeltaSize(nil, len(src))
+	out = appendDeltaSize(out, len(dst))
+	var insert []byte
+	flush := func() {
+		for len(insert) > 0 {
+			n := len(insert)
+			if n > deltaMaxInsert {
+				n = deltaMaxInsert
+			}
+			out = append(out, byte(n))
+			out = append(out, insert[:n]...)
+			insert = insert[n:]
+		}
+	}
+
+	for i := 0; i < len(dst); {
+		var offset, length int
+		if i+deltaBlockSize <= len(dst) {
+			for _, pos := range index[string(dst[i:i+deltaBlockSize])] {
+				n := deltaBlockSize
+				for pos+n < len(src) && i+n < len(dst) && src[pos+n] == dst[i+n] {
+					n++
+				}
+				if n > length {
+					offset, length = pos, n
+				}
+			}
+		}
+		if length == 0 {
+			insert = append(insert, dst[i])
+			i++
+		} else {
+			i += length
+			// extend the match backwards into pending literals
+			for offset > 0 && len(insert) > 0 && src[offset-1] == insert[len(insert)-1] {
+				offset--
+				length++
+				insert = insert[:len(insert)-1]
+			}
+			flush()
+			for length > 0 {
+				n := length
+				if n > deltaMaxCopy {
+					n = deltaMaxCopy
+				}
+				out = appendDeltaCopy(out, offset, n)
+				offset += n
+				length -= n
+			}
+		}
+		if len(out)+len(insert) > maxSize {
+			return nil
+		}
+	}
+	flush()
+	if len(out) > maxSize {
+		return nil
+	}
+	return out
+}
+
+func appendDeltaSize(out []byte, size int) []byte {
+	for size >= 0x80 {
+		out = append(out, byte(size)|0x80)
+		size >>= 7
+	}
+	return append(out, byte(size))
+}
+
+func appendDeltaCopy(out []byte, offset, size int) []byte {
+	cmd := byte(0x80)
+	var args []byte
+	for i := uint(0); i < 4; i++ {
+		if b := byte(offset >> (8 * i)); b != 0 {
+			cmd |= 1 << i
+			args = append(args, b)
+		}
+	}
+	if size != deltaMaxCopy {
+		for i := uint(0); i < 3; i++ {
+			if b := byte(size >> (8 * i)); b != 0 {
+				cmd |= 1 << (4 + i)
+				args = append(args, b)
+			}
+		}
+	}
+	out = append(out, cmd)
+	return append(out, args...)
+}
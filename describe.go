@@ -0,0 +1,301 @@
+package git
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDescribeCandidates = 10
+	// maxDescribeCandidates is the limit of git, which marks commits with
+	// a flag bit for each candidate.
+	maxDescribeCandidates = 27
+)
+
+type DescribeOptions struct {
+	// Tags uses lightweight tags as well as annotated ones.
+	Tags bool
+	// Match and Exclude are globs on tag names without refs/tags/. A tag
+	// is used if it matches any of Match, or Match is empty, and none of
+	// Exclude.
+	Match   []string
+	Exclude []string
+	// FirstParent follows only the first parent of merges.
+	FirstParent bool
+	// Candidates is how many of the nearest tags are compared to find the
+	// one with the fewest commits since, 10 if zero.
+	Candidates int
+	// ExactMatch fails unless the commit is tagged.
+	ExactMatch bool
+	// Dirty checks the index and the worktree for changes to HEAD in
+	// DescribeHead.
+	Dirty bool
+}
+
+// Description names a commit after the nearest tag reachable from it, like
+// git describe. Depth is the number of commits reachable from the commit
+// but not from the tag.
+type Description struct {
+	Tag    string
+	Depth  int
+	Commit SHA1
+	Abbrev string
+	Dirty  bool
+	// misnamed is set when an annotated tag is named differently from its
+	// ref, which git always shows with the suffix.
+	misnamed bool
+}
+
+// String formats the description like git describe, which leaves the
+// suffix out for a tagged commit.
+func (d *Description) String() string {
+	return d.format(d.misnamed || d.Depth > 0)
+}
+
+// Long formats the description as tag-N-gabbrev even for a tagged commit,
+// like git describe --long.
+func (d *Description) Long() string {
+	return d.format(true)
+}
+
+func (d *Description) format(long bool) string {
+	s := d.Tag
+	if long {
+		s += "-" + strconv.Itoa(d.Depth) + "-g" + d.Abbrev
+	}
+	if d.Dirty {
+		s += "-dirty"
+	}
+	return s
+}
+
+// describeName is the tag chosen to name a commit among those pointing to
+// it. An annotated tag wins over a lightweight one, and the newest of
+// annotated tags wins.
+type describeName struct {
+	tag       string
+	annotated bool
+	date      time.Time
+	misnamed  bool
+}
+
+// describeCandidate is a tag found while walking back from the commit. Its
+// flag marks the commits reachable from it.
+type describeCandidate struct {
+	name  *describeName
+	depth int
+	flag  uint32
+}
+
+const describeSeen uint32 = 1
+
+// Describe names the commit id points to after the nearest tag reachable
+// from it. Commits are walked back by date, and the walk stops after the
+// number of candidate tags, or when every commit left is reachable from
+// the best of them. The tag with the fewest commits since wins, the one
+// found first on a tie.
+func (r *Repository) Describe(id SHA1, opts DescribeOptions) (*Description, error) {
+	c, err := r.commitOf(id)
+	if err != nil {
+		return nil, err
+	}
+	names, err := r.describeNames(opts)
+	if err != nil {
+		return nil, err
+	}
+	d := &Description{Commit: c.id, Abbrev: r.abbrev(c.id)}
+	if n := names[c.id]; n != nil && (opts.Tags || n.annotated) {
+		d.Tag, d.misnamed = n.tag, n.misnamed
+		return d, nil
+	}
+	if opts.ExactMatch {
+		return nil, fmt.Errorf("No tag exactly matches %s", c.id)
+	}
+	max := opts.Candidates
+	if max <= 0 {
+		max = defaultDescribeCandidates
+	} else if max > maxDescribeCandidates {
+		max = maxDescribeCandidates
+	}
+
+	var (
+		flags       = map[SHA1]uint32{c.id: describeSeen}
+		queue       = newCommitQueue(commitDate)
+		candidates  []*describeCandidate
+		seen        int
+		annotated   int
+		unannotated int
+		gaveUp      *Commit
+	)
+	queue.push(c)
+	for queue.Len() > 0 {
+		c := queue.pop()
+		seen++
+		if n := names[c.id]; n != nil {
+			if !opts.Tags && !n.annotated {
+				unannotated++
+			} else if len(candidates) < max {
+				t := &describeCandidate{name: n, depth: seen - 1, flag: 1 << uint(len(candidates)+1)}
+				candidates = append(candidates, t)
+				flags[c.id] |= t.flag
+				if n.annotated {
+					annotated++
+				}
+			} else {
+				gaveUp = c
+				break
+			}
+		}
+		for _, t := range candidates {
+			if flags[c.id]&t.flag == 0 {
+				t.depth++
+			}
+		}
+
+		// stop when the last path left is known to lead to the best
+		// candidates
+		if annotated > 0 && queue.Len() == 0 {
+			depth, within := -1, uint32(0)
+			for _, t := range candidates {
+				if depth == -1 || t.depth < depth {
+					depth, within = t.depth, t.flag
+				} else if t.depth == depth {
+					within |= t.flag
+				}
+			}
+			if flags[c.id]&within == within {
+				break
+			}
+		}
+		if err := r.describeParents(c, flags, queue, opts.FirstParent); err != nil {
+			return nil, err
+		}
+	}
+	if len(candidates) == 0 {
+		if unannotated > 0 {
+			return nil, fmt.Errorf("No annotated tags can describe %s, only lightweight ones", c.id)
+		}
+		return nil, fmt.Errorf("No tags can describe %s", c.id)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].depth < candidates[j].depth
+	})
+
+	// the best candidate so far also misses the commits not walked yet
+	best := candidates[0]
+	if gaveUp != nil {
+		queue.push(gaveUp)
+	}
+	for queue.Len() > 0 {
+		c := queue.pop()
+		if flags[c.id]&best.flag == 0 {
+			best.depth++
+		} else if describeAllFlagged(queue, flags, best.flag) {
+			break
+		}
+		if err := r.describeParents(c, flags, queue, opts.FirstParent); err != nil {
+			return nil, err
+		}
+	}
+	d.Tag, d.Depth, d.misnamed = best.name.tag, best.depth, best.name.misnamed
+	return d, nil
+}
+
+// DescribeHead describes the commit HEAD points to, and marks the
+// description dirty when the index or the worktree differs from it if
+// opts.Dirty is set.
+func (r *Repository) DescribeHead(opts DescribeOptions) (*Description, error) {
+	head, err := r.Head()
+	if err != nil {
+		return nil, err
+	}
+	d, err := r.Describe(head.SHA1, opts)
+	if err != nil || !opts.Dirty {
+		return d, err
+	}
+	c, err := r.commitOf(head.SHA1)
+	if err != nil {
+		return nil, err
+	}
+	if d.Dirty, err = r.worktreeDirty(c.Tree); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// describeNames returns the tag naming each tagged commit.
+func (r *Repository) describeNames(opts DescribeOptions) (map[SHA1]*describeName, error) {
+	refs, err := r.matchingRefs("refs/tags/")
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[SHA1]*describeName)
+	for _, ref := range refs {
+		name := strings.TrimPrefix(ref.Name, "refs/tags/")
+		if !describeMatch(name, opts) {
+			continue
+		}
+		c, err := r.commitOf(ref.SHA1)
+		if err != nil { // not a commit
+			continue
+		}
+		n := &describeName{tag: name}
+		obj, err := r.Object(ref.SHA1)
+		if err != nil {
+			return nil, err
+		}
+		if tag, ok := obj.(*Tag); ok {
+			n.tag, n.annotated, n.date = tag.Name, true, tag.Tagger.Date
+			n.misnamed = tag.Name != name
+		}
+		if e := names[c.id]; e == nil || !e.annotated && n.annotated || e.annotated && n.annotated && e.date.Before(n.date) {
+			names[c.id] = n
+		}
+	}
+	return names, nil
+}
+
+func describeMatch(name string, opts DescribeOptions) bool {
+	for _, pattern := range opts.Exclude {
+		if wildmatch(pattern, name) {
+			return false
+		}
+	}
+	for _, pattern := range opts.Match {
+		if wildmatch(pattern, name) {
+			return true
+		}
+	}
+	return len(opts.Match) == 0
+}
+
+// describeParents queues the parents of c not seen yet, and marks them with
+// the flags of c.
+func (r *Repository) describeParents(c *Commit, flags map[SHA1]uint32, queue *commitQueue, firstParent bool) error {
+	for _, p := range c.Parents {
+		if flags[p.id]&describeSeen == 0 {
+			if err := r.Resolve(p); err != nil {
+				return err
+			}
+			queue.push(p)
+		}
+		flags[p.id] |= flags[c.id]
+		if firstParent {
+			break
+		}
+	}
+	return nil
+}
+
+// describeAllFlagged reports whether every queued commit has flag.
+func describeAllFlagged(queue *commitQueue, flags map[SHA1]uint32, flag uint32) bool {
+	for _, item := range queue.items {
+		if flags[item.commit.id]&flag == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,211 @@
+package git
+
+import "strings"
+
+type ChangeType int
+
+const (
+	ChangeAdd ChangeType = iota + 1
+	ChangeDelete
+	ChangeModify
+	// ChangeTypeChange is a change between a regular file, a symbolic link
+	// and a submodule.
+	ChangeTypeChange
+	ChangeRename
+	ChangeCopy
+)
+
+func (t ChangeType) String() string {
+	switch t {
+	case ChangeAdd:
+		return "A"
+	case ChangeDelete:
+		return "D"
+	case ChangeModify:
+		return "M"
+	case ChangeTypeChange:
+		return "T"
+	case ChangeRename:
+		return "R"
+	case ChangeCopy:
+		return "C"
+	}
+	return "?"
+}
+
+// Change is a difference of a single file between two trees. The old side
+// of an added file and the new side of a deleted one have a zero mode and
+// a zero id. Score is the similarity in percent of a renamed or copied
+// file to its source.
+type Change struct {
+	Type    ChangeType
+	OldPath string
+	NewPath string
+	OldMode int
+	NewMode int
+	OldID   SHA1
+	NewID   SHA1
+	Score   int
+}
+
+type DiffOptions struct {
+	// Pathspec limits the changes to the paths matching any of them, like
+	// the pathspecs given to git diff.
+	Pathspec []string
+	// DetectRenames pairs deleted and added files with the same or similar
+	// contents into renames like git diff -M.
+	DetectRenames bool
+	// DetectCopies also pairs added files with modified files and reports
+	// copies like git diff -C. It implies DetectRenames.
+	DetectCopies bool
+	// RenameThreshold is the minimum similarity in percent of a rename or
+	// copy, 50 if zero.
+	RenameThreshold int
+	// RenameLimit skips the similarity detection when the number of
+	// sources times that of destinations exceeds its square, 1000 if zero
+	// and unlimited if negative. Exact renames are detected regardless.
+	RenameLimit int
+}
+
+// DiffTrees compares two trees recursively like git diff-tree -r and
+// returns the changed files in path order. Either tree may be nil to diff
+// against an empty tree. Subtrees with the same id are skipped without
+// being read. Renamed and copied files are placed at their new path.
+func DiffTrees(a, b *Tree, opts DiffOptions) ([]*Change, error) {
+	d := &treeDiff{spec: newPathspec(opts.Pathspec)}
+	switch {
+	case a != nil:
+		d.repo = a.repo
+	case b != nil:
+		d.repo = b.repo
+	default:
+		return nil, nil
+	}
+	d.zero = d.repo.Format.zero()
+	if err := d.diff("", a, b); err != nil {
+		return nil, err
+	}
+	if opts.DetectRenames || opts.DetectCopies {
+		if err := d.detectRenames(opts); err != nil {
+			return nil, err
+		}
+	}
+	return d.changes, nil
+}
+
+type treeDiff struct {
+	repo    *Repository
+	spec    *pathspec
+	zero    SHA1
+	changes []*Change
+}
+
+func (d *treeDiff) diff(base string, a, b *Tree) error {
+	ae, err := treeEntries(a)
+	if err != nil {
+		return err
+	}
+	be, err := treeEntries(b)
+	if err != nil {
+		return err
+	}
+	for len(ae) > 0 || len(be) > 0 {
+		var cmp int
+		switch {
+		case len(ae) == 0:
+			cmp = 1
+		case len(be) == 0:
+			cmp = -1
+		default:
+			cmp = compareTreeEntries(ae[0], be[0])
+		}
+		switch {
+		case cmp < 0:
+			err = d.entry(base, ae[0], nil)
+			ae = ae[1:]
+		case cmp > 0:
+			err = d.entry(base, nil, be[0])
+			be = be[1:]
+		default:
+			err = d.entry(base, ae[0], be[0])
+			ae, be = ae[1:], be[1:]
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entry compares entries of the same name, either of which may be nil.
+// Entries of a different kind never share a name here since a tree sorts
+// after a file of the same name.
+func (d *treeDiff) entry(base string, a, b *TreeEntry) error {
+	e := a
+	if e == nil {
+		e = b
+	}
+	name := base + e.Name
+	if a != nil && b != nil && a.Mode == b.Mode && a.Object.SHA1() == b.Object.SHA1() {
+		return nil
+	}
+	if modeType(e.Mode) == "tree" {
+		if !d.spec.matchDir(name) {
+			return nil
+		}
+		var at, bt *Tree
+		if a != nil {
+			at = a.Object.(*Tree)
+		}
+		if b != nil {
+			bt = b.Object.(*Tree)
+		}
+		return d.diff(name+"/", at, bt)
+	}
+	if !d.spec.match(name) {
+		return nil
+	}
+
+	c := &Change{OldPath: name, NewPath: name, OldID: d.zero, NewID: d.zero}
+	if a != nil {
+		c.OldMode, c.OldID = a.Mode, a.Object.SHA1()
+	}
+	if b != nil {
+		c.NewMode, c.NewID = b.Mode, b.Object.SHA1()
+	}
+	switch {
+	case a == nil:
+		c.Type = ChangeAdd
+	case b == nil:
+		c.Type = ChangeDelete
+	case a.Mode&0170000 != b.Mode&0170000:
+		c.Type = ChangeTypeChange
+	default:
+		c.Type = ChangeModify
+	}
+	d.changes = append(d.changes, c)
+	return nil
+}
+
+func treeEntries(t *Tree) ([]*TreeEntry, error) {
+	if t == nil {
+		return nil, nil
+	}
+	if err := t.Resolve(); err != nil {
+		return nil, err
+	}
+	return t.Entries, nil
+}
+
+// compareTreeEntries orders entries like git, which compares the name of a
+// tree as if it ended with '/'.
+func compareTreeEntries(a, b *TreeEntry) int {
+	an, bn := a.Name, b.Name
+	if modeType(a.Mode) == "tree" {
+		an += "/"
+	}
+	if modeType(b.Mode) == "tree" {
+		bn += "/"
+	}
+	return strings.Compare(an, bn)
+}
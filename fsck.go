@@ -0,0 +1,405 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	FsckMissing   = "missing"
+	FsckDangling  = "dangling"
+	FsckMalformed = "malformed"
+)
+
+type FsckReport struct {
+	Problems []*FsckProblem `json:"problems"`
+}
+
+// FsckProblem describes a single finding. Check holds git's fsck message id
+// such as "treeNotSorted" or "badEmail" for malformed objects.
+type FsckProblem struct {
+	Kind    string `json:"kind"`
+	Check   string `json:"check,omitempty"`
+	ID      SHA1   `json:"id"`
+	Type    string `json:"type,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type fsckLink struct {
+	id   SHA1
+	typ  string
+	from string
+}
+
+type fsck struct {
+	repo    *Repository
+	report  *FsckReport
+	seen    map[SHA1]bool
+	shallow map[SHA1]bool
+}
+
+func (r *Repository) Fsck() (*FsckReport, error) {
+	f := &fsck{
+		repo:   r,
+		report: &FsckReport{Problems: []*FsckProblem{}},
+		seen:   make(map[SHA1]bool),
+	}
+	var err error
+	if f.shallow, err = r.shallowCommits(); err != nil {
+		return nil, err
+	}
+
+	refs, err := r.matchingRefs("")
+	if err != nil {
+		return nil, err
+	}
+	if head, err := r.Head(); err == nil {
+		refs = append(refs, &Ref{Name: "HEAD", SHA1: head.SHA1})
+	}
+	var queue []fsckLink
+	for _, ref := range refs {
+		queue = append(queue, fsckLink{id: ref.SHA1, from: ref.Name})
+	}
+	for len(queue) > 0 {
+		link := queue[0]
+		queue = queue[1:]
+		if f.seen[link.id] {
+			continue
+		}
+		f.seen[link.id] = true
+		_, links := f.inspect(link)
+		queue = append(queue, links...)
+	}
+
+	ids, err := r.objectIDs()
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sha1s(ids))
+	var unreachable []SHA1
+	types := make(map[SHA1]string)
+	referenced := make(map[SHA1]bool)
+	for _, id := range ids {
+		if f.seen[id] {
+			continue
+		}
+		f.seen[id] = true
+		typ, links := f.inspect(fsckLink{id: id})
+		for _, link := range links {
+			referenced[link.id] = true
+		}
+		unreachable = append(unreachable, id)
+		types[id] = typ
+	}
+	for _, id := range unreachable {
+		if !referenced[id] {
+			f.add(FsckDangling, "", id, types[id], "")
+		}
+	}
+	return f.report, nil
+}
+
+func (f *fsck) add(kind, check string, id SHA1, typ, msg string) {
+	f.report.Problems = append(f.report.Problems, &FsckProblem{
+		Kind:    kind,
+		Check:   check,
+		ID:      id,
+		Type:    typ,
+		Message: msg,
+	})
+}
+
+func (f *fsck) malformed(check string, id SHA1, typ, format string, args ...interface{}) {
+	f.add(FsckMalformed, check, id, typ, fmt.Sprintf(format, args...))
+}
+
+func (f *fsck) inspect(link fsckLink) (string, []fsckLink) {
+	typ, data, err := f.repo.readRaw(link.id)
+	if err == ErrObjectNotFound {
+		f.add(FsckMissing, "", link.id, link.typ, "referenced by "+link.from)
+		return "", nil
+	} else if err != nil {
+		f.malformed("corruptObject", link.id, link.typ, "%v", err)
+		return "", nil
+	}
+	if link.typ != "" && typ != link.typ {
+		f.malformed("badType", link.id, typ, "expected %s from %s", link.typ, link.from)
+	}
+
+	actual, err := HashObject(f.repo.Format, typ, data)
+	if err != nil {
+		f.malformed("sha1Collision", link.id, typ, "%v", err)
+	} else if actual != link.id {
+		f.malformed("hashMismatch", link.id, typ, "content hashes to %s", actual)
+	}
+
+	switch typ {
+	case "commit":
+		return typ, f.checkCommit(link.id, data)
+	case "tag":
+		return typ, f.checkTag(link.id, data)
+	case "tree":
+		return typ, f.checkTree(link.id, data)
+	case "blob":
+		return typ, nil
+	}
+	f.malformed("badType", link.id, typ, "unknown object type")
+	return typ, nil
+}
+
+func (f *fsck) checkCommit(id SHA1, data []byte) []fsckLink {
+	var links []fsckLink
+	headers := objectHeaders(data)
+	from := "commit " + id.String()
+
+	if len(headers) == 0 || headers[0].key != "tree" {
+		f.malformed("missingTree", id, "commit", "invalid format - expected 'tree' line")
+		return links
+	}
+	if tree, err := NewSHA1(headers[0].value); err != nil || tree.Format() != f.repo.Format {
+		f.malformed("badTreeSha1", id, "commit", "invalid 'tree' line format - bad sha1")
+	} else {
+		links = append(links, fsckLink{id: tree, typ: "tree", from: from})
+	}
+	headers = headers[1:]
+
+	for len(headers) > 0 && headers[0].key == "parent" {
+		if parent, err := NewSHA1(headers[0].value); err != nil || parent.Format() != f.repo.Format {
+			f.malformed("badParentSha1", id, "commit", "invalid 'parent' line format - bad sha1")
+		} else if !f.shallow[id] { // the history of a shallow clone ends here
+			links = append(links, fsckLink{id: parent, typ: "commit", from: from})
+		}
+		headers = headers[1:]
+	}
+
+	for _, key := range []string{"author", "committer"} {
+		if len(headers) == 0 || headers[0].key != key {
+			check := "missingAuthor"
+			if key == "committer" {
+				check = "missingCommitter"
+			}
+			f.malformed(check, id, "commit", "invalid format - expected '%s' line", key)
+			return links
+		}
+		if check := checkIdent(headers[0].value); check != "" {
+			f.malformed(check, id, "commit", "invalid %s line", key)
+		}
+		headers = headers[1:]
+	}
+	return links
+}
+
+func (f *fsck) checkTag(id SHA1, data []byte) []fsckLink {
+	headers := objectHeaders(data)
+	var (
+		target SHA1
+		links  []fsckLink
+		err    error
+	)
+
+	if len(headers) == 0 || headers[0].key != "object" {
+		f.malformed("missingObject", id, "tag", "invalid format - expected 'object' line")
+		return links
+	}
+	if target, err = NewSHA1(headers[0].value); err != nil || target.Format() != f.repo.Format {
+		f.malformed("badObjectSha1", id, "tag", "invalid 'object' line format - bad sha1")
+		return links
+	}
+	if len(headers) < 2 || headers[1].key != "type" {
+		f.malformed("missingTypeEntry", id, "tag", "invalid format - expected 'type' line")
+		return links
+	}
+	if typ := headers[1].value; !validObjectType(typ) {
+		f.malformed("badType", id, "tag", "invalid 'type' value")
+	} else {
+		links = append(links, fsckLink{id: target, typ: typ, from: "tag " + id.String()})
+	}
+	if len(headers) < 3 || headers[2].key != "tag" {
+		f.malformed("missingTagEntry", id, "tag", "invalid format - expected 'tag' line")
+		return links
+	}
+	if len(headers) > 3 && headers[3].key == "tagger" {
+		if check := checkIdent(headers[3].value); check != "" {
+			f.malformed(check, id, "tag", "invalid tagger line")
+		}
+	}
+	return links
+}
+
+func (f *fsck) checkTree(id SHA1, data []byte) []fsckLink {
+	var (
+		links    []fsckLink
+		prev     []byte
+		prevMode int
+		found    = make(map[string]bool)
+		from     = "tree " + id.String()
+	)
+	report := func(check, msg string) {
+		if !found[check] {
+			found[check] = true
+			f.malformed(check, id, "tree", "%s", msg)
+		}
+	}
+
+	err := scanTree(data, f.repo.Format, func(modeText, name []byte, entry SHA1) error {
+		mode := 0
+		for _, c := range modeText {
+			if c < '0' || c > '7' {
+				report("badFilemode", "contains bad file modes")
+				break
+			}
+			mode = mode<<3 | int(c-'0')
+		}
+		if len(modeText) > 0 && modeText[0] == '0' {
+			report("zeroPaddedFilemode", "contains zero-padded file modes")
+		}
+		switch mode {
+		case 0100644, 0100755, 0120000, 0040000, 0160000:
+		case 0100664:
+		default:
+			report("badFilemode", "contains bad file modes")
+		}
+
+		switch {
+		case len(name) == 0:
+			report("emptyName", "contains empty pathname")
+		case bytes.IndexByte(name, '/') != -1:
+			report("fullPathname", "contains full pathnames")
+		case string(name) == ".":
+			report("hasDot", "contains '.'")
+		case string(name) == "..":
+			report("hasDotdot", "contains '..'")
+		case strings.EqualFold(string(name), ".git"):
+			report("hasDotgit", "contains '.git'")
+		}
+
+		if prev != nil {
+			if bytes.Equal(prev, name) {
+				report("duplicateEntries", "contains duplicate file entries")
+			} else if compareTreeNames(prev, prevMode, name, mode) > 0 {
+				report("treeNotSorted", "not properly sorted")
+			}
+		}
+		prev, prevMode = name, mode
+
+		if typ := modeType(mode); typ != "commit" {
+			links = append(links, fsckLink{id: entry, typ: typ, from: from})
+		}
+		return nil
+	})
+	if err != nil {
+		report("badTree", "cannot be parsed as a tree")
+	}
+	return links
+}
+
+// compareTreeNames orders entries the way git sorts trees, where the name
+// of a subtree compares as if it had a trailing slash.
+func compareTreeNames(a []byte, amode int, b []byte, bmode int) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	if c := bytes.Compare(a[:n], b[:n]); c != 0 {
+		return c
+	}
+	c1, c2 := treeNameTerminator(a, n, amode), treeNameTerminator(b, n, bmode)
+	switch {
+	case c1 < c2:
+		return -1
+	case c1 > c2:
+		return 1
+	}
+	return 0
+}
+
+func treeNameTerminator(name []byte, n, mode int) byte {
+	if n < len(name) {
+		return name[n]
+	}
+	if modeType(mode) == "tree" {
+		return '/'
+	}
+	return 0
+}
+
+// checkIdent validates "Name <email> timestamp tz" and returns the fsck
+// message id of the first problem found.
+func checkIdent(line string) string {
+	lt := strings.IndexByte(line, '<')
+	if lt == -1 {
+		return "missingEmail"
+	}
+	if lt == 0 || line[lt-1] != ' ' {
+		return "missingSpaceBeforeEmail"
+	}
+	if strings.IndexByte(line[:lt], '>') != -1 {
+		return "badName"
+	}
+	gt := strings.IndexByte(line[lt+1:], '>')
+	if gt == -1 || strings.IndexByte(line[lt+1:lt+1+gt], '<') != -1 {
+		return "badEmail"
+	}
+	rest := line[lt+1+gt+1:]
+	if !strings.HasPrefix(rest, " ") {
+		return "missingSpaceBeforeDate"
+	}
+	rest = rest[1:]
+	sp := strings.IndexByte(rest, ' ')
+	if sp <= 0 || strings.Trim(rest[:sp], "0123456789") != "" {
+		return "badDate"
+	}
+	if rest[0] == '0' && sp > 1 {
+		return "zeroPaddedDate"
+	}
+	tz := rest[sp+1:]
+	if len(tz) != 5 || (tz[0] != '+' && tz[0] != '-') || strings.Trim(tz[1:], "0123456789") != "" {
+		return "badTimezone"
+	}
+	return ""
+}
+
+type objectHeader struct {
+	key   string
+	value string
+}
+
+// objectHeaders splits the header part of a commit or tag, folding
+// continuation lines into the preceding header.
+func objectHeaders(data []byte) []objectHeader {
+	var headers []objectHeader
+	for len(data) > 0 {
+		pos := bytes.IndexByte(data, '\n')
+		if pos == -1 {
+			pos = len(data)
+		}
+		line := string(data[:pos])
+		if pos < len(data) {
+			data = data[pos+1:]
+		} else {
+			data = nil
+		}
+		if line == "" {
+			break
+		}
+		if line[0] == ' ' && len(headers) > 0 {
+			headers[len(headers)-1].value += "\n" + line[1:]
+			continue
+		}
+		kv := strings.SplitN(line, " ", 2)
+		h := objectHeader{key: kv[0]}
+		if len(kv) == 2 {
+			h.value = kv[1]
+		}
+		headers = append(headers, h)
+	}
+	return headers
+}
+
+type sha1s []SHA1
+
+func (s sha1s) Len() int           { return len(s) }
+func (s sha1s) Less(i, j int) bool { return s[i].Compare(s[j]) < 0 }
+func (s sha1s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,308 @@
+package git
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const DefaultPruneExpire = 14 * 24 * time.Hour
+
+type GCOptions struct {
+	// PruneExpire is the grace period for unreachable loose objects. Zero
+	// means DefaultPruneExpire and a negative value prunes them all.
+	PruneExpire time.Duration
+}
+
+type looseObject struct {
+	id      SHA1
+	path    string
+	modTime time.Time
+}
+
+// GC packs reachable loose objects into a new pack, removes loose objects
+// which are already packed and prunes unreachable ones past the grace period.
+func (r *Repository) GC(opts GCOptions) error {
+	expire := opts.PruneExpire
+	if expire == 0 {
+		expire = DefaultPruneExpire
+	}
+	cutoff := time.Now().Add(-expire)
+
+	roots, weak, err := r.reachabilityRoots()
+	if err != nil {
+		return err
+	}
+	reachable := make(map[SHA1]bool)
+	err = r.walkObjects(roots, weak, func(id SHA1, typ string, data []byte, path string) error {
+		reachable[id] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	loose, err := r.looseObjects()
+	if err != nil {
+		return err
+	}
+	if _, err = r.openPacks(); err != nil {
+		return err
+	}
+	var ids []SHA1
+	for _, obj := range loose {
+		if reachable[obj.id] && !r.packed(obj.id) {
+			ids = append(ids, obj.id)
+		}
+	}
+	if len(ids) > 0 {
+		if _, err = r.writePack(ids); err != nil {
+			return err
+		}
+	}
+
+	for _, obj := range loose {
+		if r.packed(obj.id) || (!reachable[obj.id] && obj.modTime.Before(cutoff)) {
+			if err = os.Remove(obj.path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			os.Remove(filepath.Dir(obj.path)) // succeeds only if empty
+		}
+	}
+	return nil
+}
+
+func (r *Repository) writePack(ids []SHA1) (string, error) {
+	dir := filepath.Join(r.root, "objects", "pack")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	packFile, err := ioutil.TempFile(dir, "tmp_pack_")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(packFile.Name())
+	defer packFile.Close()
+
+	bw := bufio.NewWriter(packFile)
+	pw, err := NewPackWriter(bw, r.Format, uint32(len(ids)))
+	if err != nil {
+		return "", err
+	}
+	for _, id := range ids {
+		typ, data, err := r.readRaw(id)
+		if err != nil {
+			return "", err
+		}
+		if _, err = pw.WriteObject(typ, data); err != nil {
+			return "", err
+		}
+	}
+	sum, err := pw.Close()
+	if err != nil {
+		return "", err
+	}
+	if err = bw.Flush(); err != nil {
+		return "", err
+	}
+	return r.installPack(pw, packFile, sum)
+}
+
+// installPack moves a completed pack into place. The index is renamed first
+// since readers discover packs by the pack file and then open its index.
+func (r *Repository) installPack(pw *PackWriter, packFile *os.File, sum SHA1) (string, error) {
+	dir := filepath.Dir(packFile.Name())
+	if err := packFile.Sync(); err != nil {
+		return "", err
+	}
+	idxFile, err := ioutil.TempFile(dir, "tmp_idx_")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(idxFile.Name())
+	defer idxFile.Close()
+
+	bw := bufio.NewWriter(idxFile)
+	if err = pw.WriteIndex(bw); err != nil {
+		return "", err
+	}
+	if err = bw.Flush(); err != nil {
+		return "", err
+	}
+	if err = idxFile.Sync(); err != nil {
+		return "", err
+	}
+
+	base := filepath.Join(dir, "pack-"+sum.String())
+	if err = os.Chmod(idxFile.Name(), 0444); err != nil {
+		return "", err
+	}
+	if err = os.Chmod(packFile.Name(), 0444); err != nil {
+		return "", err
+	}
+	if err = os.Rename(idxFile.Name(), base+".idx"); err != nil {
+		return "", err
+	}
+	if err = os.Rename(packFile.Name(), base+".pack"); err != nil {
+		return "", err
+	}
+	if _, err = r.openPacks(); err != nil {
+		return "", err
+	}
+	return base + ".pack", nil
+}
+
+// reachabilityRoots returns the objects kept by refs and HEAD, and those
+// kept by reflogs and the index which may have been pruned already.
+func (r *Repository) reachabilityRoots() ([]SHA1, []SHA1, error) {
+	var roots []SHA1
+	refs, err := r.matchingRefs("")
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, ref := range refs {
+		roots = append(roots, ref.SHA1)
+	}
+	if head, err := r.Head(); err == nil {
+		roots = append(roots, head.SHA1)
+	}
+
+	weak, err := r.reflogObjects()
+	if err != nil {
+		return nil, nil, err
+	}
+	index, err := readIndexObjects(filepath.Join(r.root, "index"), r.Format)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	return roots, append(weak, index...), nil
+}
+
+func (r *Repository) reflogObjects() ([]SHA1, error) {
+	names, err := r.refs.reflogNames()
+	if err != nil {
+		return nil, err
+	}
+	var ids []SHA1
+	for _, name := range names {
+		entries, err := r.Reflog(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			for _, id := range []SHA1{e.Old, e.New} {
+				if !id.IsZero() {
+					ids = append(ids, id)
+				}
+			}
+		}
+	}
+	return ids, nil
+}
+
+// walkObjects visits every object reachable from roots and then from weak
+// exactly once, skipping the objects missing below weak roots like git.
+// Parents of the commits of a shallow clone are not walked. Path is the
+// name under which a blob or tree was first found.
+func (r *Repository) walkObjects(roots, weak []SHA1, fn func(id SHA1, typ string, data []byte, path string) error) error {
+	type item struct {
+		id   SHA1
+		path string
+	}
+	shallow, err := r.shallowCommits()
+	if err != nil {
+		return err
+	}
+	seen := make(map[SHA1]bool)
+	walk := func(roots []SHA1, missingOK bool) error {
+		var stack []item
+		for i := len(roots) - 1; i >= 0; i-- {
+			stack = append(stack, item{id: roots[i]})
+		}
+		for len(stack) > 0 {
+			it := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if seen[it.id] {
+				continue
+			}
+			seen[it.id] = true
+
+			typ, data, err := r.readRaw(it.id)
+			if err == ErrObjectNotFound && missingOK {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if err = fn(it.id, typ, data, it.path); err != nil {
+				return err
+			}
+
+			var next []item
+			switch typ {
+			case "commit", "tag":
+				for _, h := range objectHeaders(data) {
+					switch h.key {
+					case "parent":
+						if shallow[it.id] {
+							continue
+						}
+						fallthrough
+					case "tree", "object":
+						id, err := NewSHA1(h.value)
+						if err != nil {
+							return err
+						}
+						next = append(next, item{id: id})
+					}
+				}
+			case "tree":
+				err = scanTree(data, r.Format, func(mode, name []byte, id SHA1) error {
+					if string(mode) != "160000" {
+						next = append(next, item{id: id, path: strings.TrimPrefix(it.path+"/"+string(name), "/")})
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			for i := len(next) - 1; i >= 0; i-- {
+				stack = append(stack, next[i])
+			}
+		}
+		return nil
+	}
+	if err = walk(roots, false); err != nil {
+		return err
+	}
+	return walk(weak, true)
+}
+
+func (r *Repository) looseObjects() ([]*looseObject, error) {
+	dirs, err := filepath.Glob(filepath.Join(r.root, "objects", "[0-9a-f][0-9a-f]"))
+	if err != nil {
+		return nil, err
+	}
+	var objs []*looseObject
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			id, err := NewSHA1(filepath.Base(dir) + file.Name())
+			if err != nil || id.Format() != r.Format {
+				continue
+			}
+			objs = append(objs, &looseObject{
+				id:      id,
+				path:    filepath.Join(dir, file.Name()),
+				modTime: file.ModTime(),
+			})
+		}
+	}
+	return objs, nil
+}
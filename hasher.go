@@ -0,0 +1,56 @@
+package git
+
+import (
+	"errors"
+	"hash"
+	"strconv"
+
+	"github.com/pjbgf/sha1cd"
+)
+
+var ErrSHA1Collision = errors.New("SHA-1 collision detected")
+
+type ObjectHasher struct {
+	format ObjectFormat
+	h      hash.Hash
+}
+
+func NewObjectHasher(format ObjectFormat, typ string, size int64) *ObjectHasher {
+	h := &ObjectHasher{
+		format: format,
+		h:      format.newHash(),
+	}
+	h.h.Write([]byte(typ + " " + strconv.FormatInt(size, 10) + "\x00"))
+	return h
+}
+
+func (h *ObjectHasher) Write(p []byte) (int, error) {
+	return h.h.Write(p)
+}
+
+func (h *ObjectHasher) Sum() (SHA1, error) {
+	sum, err := checksum(h.h)
+	if err != nil {
+		return h.format.zero(), err
+	}
+	return sha1FromBytes(sum), nil
+}
+
+func HashObject(format ObjectFormat, typ string, data []byte) (SHA1, error) {
+	h := NewObjectHasher(format, typ, int64(len(data)))
+	h.Write(data)
+	return h.Sum()
+}
+
+// checksum returns the digest of h, failing if a SHA-1 collision attack was
+// detected while hashing.
+func checksum(h hash.Hash) ([]byte, error) {
+	if cd, ok := h.(sha1cd.CollisionResistantHash); ok {
+		sum, collision := cd.CollisionResistantSum(nil)
+		if collision {
+			return nil, ErrSHA1Collision
+		}
+		return sum, nil
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,308 @@
+package git
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+var indexMagic = [4]byte{'D', 'I', 'R', 'C'}
+
+type indexHeader struct {
+	Magic   [4]byte
+	Version uint32
+	Entries uint32
+}
+
+// indexEntry is a file staged in the index, with the size and the
+// modification time its file in the worktree had when it was staged.
+type indexEntry struct {
+	path         string
+	mode         int
+	id           SHA1
+	stage        int
+	size         uint32
+	mtime        time.Time
+	skipWorktree bool
+}
+
+// index holds the entries of an index file in order, and the trees recorded
+// in its cache-tree extension.
+type index struct {
+	entries []*indexEntry
+	trees   []SHA1
+}
+
+// readIndexObjects returns the ids of blobs staged in the index file and of
+// trees recorded in its cache-tree extension.
+func readIndexObjects(path string, format ObjectFormat) ([]SHA1, error) {
+	idx, err := readIndex(path, format)
+	if err != nil {
+		return nil, err
+	}
+	var ids []SHA1
+	for _, e := range idx.entries {
+		if modeType(e.mode) != "commit" {
+			ids = append(ids, e.id)
+		}
+	}
+	return append(ids, idx.trees...), nil
+}
+
+func readIndex(path string, format ObjectFormat) (*index, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var header indexHeader
+	if err = binary.Read(bytes.NewReader(data), binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Magic != indexMagic || header.Version < 2 || header.Version > 4 {
+		return nil, ErrUnknownFormat
+	}
+
+	size := format.Size()
+	if len(data) < 12+size {
+		return nil, ErrUnknownFormat
+	}
+	body := data[12 : len(data)-size]
+	pos := 0
+	idx := new(index)
+	var name string
+	for i := uint32(0); i < header.Entries; i++ {
+		start := pos
+		if len(body) < pos+40+size+2 {
+			return nil, ErrUnknownFormat
+		}
+		e := &indexEntry{
+			mode:  int(binary.BigEndian.Uint32(body[pos+24:])),
+			id:    sha1FromBytes(body[pos+40 : pos+40+size]),
+			size:  binary.BigEndian.Uint32(body[pos+36:]),
+			mtime: time.Unix(int64(binary.BigEndian.Uint32(body[pos+8:])), int64(binary.BigEndian.Uint32(body[pos+12:]))),
+		}
+		pos += 40 + size
+		flags := binary.BigEndian.Uint16(body[pos:])
+		e.stage = int(flags>>12) & 3
+		pos += 2
+		if flags&0x4000 != 0 {
+			if len(body) < pos+2 {
+				return nil, ErrUnknownFormat
+			}
+			e.skipWorktree = binary.BigEndian.Uint16(body[pos:])&0x4000 != 0
+			pos += 2
+		}
+		if header.Version == 4 {
+			// the path drops as many bytes from the end of the previous
+			// one as a varint says before appending its own
+			var strip int
+			if strip, pos = readIndexVarint(body, pos); strip > len(name) {
+				return nil, ErrUnknownFormat
+			}
+			name = name[:len(name)-strip]
+		} else {
+			name = ""
+		}
+		nul := bytes.IndexByte(body[pos:], 0)
+		if nul == -1 {
+			return nil, ErrUnknownFormat
+		}
+		name += string(body[pos : pos+nul])
+		e.path = name
+		pos += nul + 1
+		if header.Version < 4 {
+			// entries are padded with NULs to a multiple of 8 bytes
+			pos = start + (pos-start+7)&^7
+		}
+		idx.entries = append(idx.entries, e)
+	}
+
+	for pos+8 <= len(body) {
+		sig := string(body[pos : pos+4])
+		n := int(binary.BigEndian.Uint32(body[pos+4:]))
+		pos += 8
+		if pos+n > len(body) {
+			return nil, ErrUnknownFormat
+		}
+		if sig == "TREE" {
+			trees, err := parseCacheTree(body[pos:pos+n], format)
+			if err != nil {
+				return nil, err
+			}
+			idx.trees = append(idx.trees, trees...)
+		}
+		pos += n
+	}
+	return idx, nil
+}
+
+// readIndexVarint reads a varint as the offsets of deltas are encoded,
+// returning it with the position following it.
+func readIndexVarint(data []byte, pos int) (int, int) {
+	n := 0
+	for i := 0; pos < len(data); i++ {
+		c := data[pos]
+		pos++
+		if i > 0 {
+			n++
+		}
+		n = n<<7 | int(c&0x7f)
+		if c&0x80 == 0 {
+			break
+		}
+	}
+	return n, pos
+}
+
+func parseCacheTree(data []byte, format ObjectFormat) ([]SHA1, error) {
+	var ids []SHA1
+	for len(data) > 0 {
+		nul := bytes.IndexByte(data, 0)
+		if nul == -1 {
+			return nil, ErrUnknownFormat
+		}
+		data = data[nul+1:]
+		nl := bytes.IndexByte(data, '\n')
+		sp := bytes.IndexByte(data, ' ')
+		if nl == -1 || sp == -1 || sp > nl {
+			return nil, ErrUnknownFormat
+		}
+		count, err := strconv.Atoi(string(data[:sp]))
+		if err != nil {
+			return nil, ErrUnknownFormat
+		}
+		data = data[nl+1:]
+		if count >= 0 { // invalidated entries have no id
+			if len(data) < format.Size() {
+				return nil, ErrUnknownFormat
+			}
+			ids = append(ids, sha1FromBytes(data[:format.Size()]))
+			data = data[format.Size():]
+		}
+	}
+	return ids, nil
+}
+
+// worktreeDirty reports whether the index or the files in the worktree
+// differ from tree, like git diff-index HEAD. Files whose size and
+// modification time match the index are not read, and submodules are not
+// checked.
+func (r *Repository) worktreeDirty(tree *Tree) (bool, error) {
+	if r.Bare {
+		return false, errors.New("No worktree in a bare repository")
+	}
+	path := filepath.Join(r.root, "index")
+	idx, err := readIndex(path, r.Format)
+	if os.IsNotExist(err) {
+		idx, err = new(index), nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var staged time.Time
+	if fi, err := os.Stat(path); err == nil {
+		staged = fi.ModTime()
+	}
+
+	entries := make(map[string]*indexEntry)
+	for _, e := range idx.entries {
+		if e.stage != 0 { // unmerged
+			return true, nil
+		}
+		entries[e.path] = e
+	}
+	if dirty, err := r.indexDiffers(tree, "", entries); err != nil || dirty {
+		return dirty, err
+	}
+	if len(entries) > 0 { // added
+		return true, nil
+	}
+
+	filemode := r.config.Bool("core.filemode", true)
+	for _, e := range idx.entries {
+		if dirty, err := r.worktreeFileDiffers(e, staged, filemode); err != nil || dirty {
+			return dirty, err
+		}
+	}
+	return false, nil
+}
+
+// indexDiffers compares the files in tree with the index entries below
+// prefix, removing those it finds from entries.
+func (r *Repository) indexDiffers(tree *Tree, prefix string, entries map[string]*indexEntry) (bool, error) {
+	if err := r.Resolve(tree); err != nil {
+		return false, err
+	}
+	for _, te := range tree.Entries {
+		path := prefix + te.Name
+		if sub, ok := te.Object.(*Tree); ok {
+			// a sparse index stages whole directories out of the worktree
+			if e := entries[path+"/"]; e != nil {
+				delete(entries, path+"/")
+				if e.id != sub.SHA1() {
+					return true, nil
+				}
+				continue
+			}
+			if dirty, err := r.indexDiffers(sub, path+"/", entries); err != nil || dirty {
+				return dirty, err
+			}
+			continue
+		}
+		e := entries[path]
+		if e == nil || e.mode != te.Mode || e.id != te.Object.SHA1() {
+			return true, nil
+		}
+		delete(entries, path)
+	}
+	return false, nil
+}
+
+// worktreeFileDiffers reports whether the file of an index entry was
+// changed or removed in the worktree. The file is hashed unless its stat
+// data matches the entry and it was modified before the index was written.
+func (r *Repository) worktreeFileDiffers(e *indexEntry, staged time.Time, filemode bool) (bool, error) {
+	if e.skipWorktree || modeType(e.mode) != "blob" {
+		return false, nil
+	}
+	path := filepath.Join(r.Path, filepath.FromSlash(e.path))
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if pe, ok := err.(*os.PathError); os.IsNotExist(err) || ok && pe.Err == syscall.ENOTDIR {
+			return true, nil
+		}
+		return false, err
+	}
+	var data []byte
+	if e.mode&0170000 == 0120000 {
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return true, nil
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			return false, err
+		}
+		data = []byte(target)
+	} else {
+		if !fi.Mode().IsRegular() || filemode && fi.Mode()&0100 != os.FileMode(e.mode&0100) {
+			return true, nil
+		}
+		if e.size == uint32(fi.Size()) && e.mtime.Equal(fi.ModTime()) && e.mtime.Before(staged) {
+			return false, nil
+		}
+		if data, err = ioutil.ReadFile(path); err != nil {
+			return false, err
+		}
+	}
+	id, err := HashObject(r.Format, "blob", data)
+	if err != nil {
+		return false, err
+	}
+	return id != e.id, nil
+}
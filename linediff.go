@@ -0,0 +1,1006 @@
+package git
+
+import (
+	"bytes"
+	"math"
+)
+
+// DiffAlgorithm selects how lines are matched between two texts. All of
+// them produce the same results as the algorithms of git diff.
+type DiffAlgorithm int
+
+const (
+	// DiffMyers is git's default algorithm, which gives up finding the
+	// shortest edit for large differences.
+	DiffMyers DiffAlgorithm = iota
+	// DiffMinimal always finds the shortest edit like git diff --minimal.
+	DiffMinimal
+	// DiffPatience matches the lines unique to both sides first.
+	DiffPatience
+	// DiffHistogram extends patience with lines occurring a few times.
+	DiffHistogram
+)
+
+// LineChange is a run of lines deleted from the old text and lines added
+// to the new text in their place. Lines are counted from zero, and either
+// run may be empty.
+type LineChange struct {
+	OldStart int
+	OldLines int
+	NewStart int
+	NewLines int
+}
+
+// DiffBlobs compares the contents of two blobs line by line. Either blob
+// may be nil for an empty one.
+func DiffBlobs(a, b *Blob, algo DiffAlgorithm) ([]LineChange, error) {
+	var data [2][]byte
+	for i, blob := range []*Blob{a, b} {
+		if blob == nil {
+			continue
+		}
+		if err := blob.Resolve(); err != nil {
+			return nil, err
+		}
+		data[i] = blob.Data
+	}
+	return newLineDiff(data[0], data[1], algo).changes(), nil
+}
+
+const (
+	xdlMaxCostMin     = 256
+	xdlHeurMinCost    = 256
+	xdlSnakeCnt       = 20
+	xdlKHeur          = 4
+	xdlMaxEqLimit     = 1024
+	xdlSimscanWindow  = 100
+	xdlKpdisRun       = 4
+	histogramMaxChain = 64
+)
+
+// diffFile is one side of a line diff, like xdfile_t of git's xdiff.
+type diffFile struct {
+	recs [][]byte
+	// ha holds the class of each line, the same for equal lines of both
+	// sides
+	ha []int
+	// rchg marks the changed lines, shifted by one to have a sentinel at
+	// both ends
+	rchg []bool
+
+	// the lines left to the Myers algorithm
+	dstart, dend int
+	rindex       []int
+	rha          []int
+}
+
+func (f *diffFile) nrec() int                { return len(f.recs) }
+func (f *diffFile) changed(i int) bool       { return f.rchg[i+1] }
+func (f *diffFile) setChanged(i int, v bool) { f.rchg[i+1] = v }
+
+type lineDiff struct {
+	a, b *diffFile
+	// count1 and count2 hold the number of lines of each class in a and b
+	count1, count2 []int
+}
+
+func newLineDiff(a, b []byte, algo DiffAlgorithm) *lineDiff {
+	d := newLineDiffLines(splitLines(a), splitLines(b))
+	switch algo {
+	case DiffPatience:
+		d.patience(1, d.a.nrec(), 1, d.b.nrec())
+	case DiffHistogram:
+		d.histogram(1, d.a.nrec(), 1, d.b.nrec())
+	default:
+		d.myers(algo == DiffMinimal)
+	}
+	d.compact(d.a, d.b)
+	d.compact(d.b, d.a)
+	return d
+}
+
+func newLineDiffLines(a, b [][]byte) *lineDiff {
+	d := &lineDiff{a: &diffFile{recs: a}, b: &diffFile{recs: b}}
+	classes := make(map[string]int)
+	for pass, f := range []*diffFile{d.a, d.b} {
+		f.ha = make([]int, len(f.recs))
+		f.rchg = make([]bool, len(f.recs)+2)
+		f.dend = len(f.recs) - 1
+		for i, rec := range f.recs {
+			c, ok := classes[string(rec)]
+			if !ok {
+				c = len(classes)
+				classes[string(rec)] = c
+				d.count1 = append(d.count1, 0)
+				d.count2 = append(d.count2, 0)
+			}
+			f.ha[i] = c
+			if pass == 0 {
+				d.count1[c]++
+			} else {
+				d.count2[c]++
+			}
+		}
+	}
+	return d
+}
+
+// splitLines splits data into lines keeping their line feeds.
+func splitLines(data []byte) [][]byte {
+	var lines [][]byte
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n') + 1
+		if i == 0 {
+			i = len(data)
+		}
+		lines = append(lines, data[:i])
+		data = data[i:]
+	}
+	return lines
+}
+
+// changes collects the runs of changed lines.
+func (d *lineDiff) changes() []LineChange {
+	var changes []LineChange
+	i1, i2 := 0, 0
+	for i1 < d.a.nrec() || i2 < d.b.nrec() {
+		if !d.a.changed(i1) && !d.b.changed(i2) {
+			i1++
+			i2++
+			continue
+		}
+		c := LineChange{OldStart: i1, NewStart: i2}
+		for ; d.a.changed(i1); i1++ {
+			c.OldLines++
+		}
+		for ; d.b.changed(i2); i2++ {
+			c.NewLines++
+		}
+		changes = append(changes, c)
+	}
+	return changes
+}
+
+// myers runs xdiff's variant of the Myers algorithm, which first drops
+// the lines which cannot match and gives up on the shortest edit when it
+// gets too expensive unless minimal is set.
+func (d *lineDiff) myers(minimal bool) {
+	d.trimEnds()
+	d.cleanupRecords()
+	n1, n2 := len(d.a.rha), len(d.b.rha)
+	ndiags := n1 + n2 + 3
+	m := &myersDiff{
+		a:      d.a,
+		b:      d.b,
+		kvdf:   make([]int, ndiags),
+		kvdb:   make([]int, ndiags),
+		off:    n2 + 1,
+		mxcost: bogosqrt(ndiags),
+	}
+	if m.mxcost < xdlMaxCostMin {
+		m.mxcost = xdlMaxCostMin
+	}
+	m.compare(0, n1, 0, n2, minimal)
+}
+
+func (d *lineDiff) trimEnds() {
+	a, b := d.a, d.b
+	lim := a.nrec()
+	if b.nrec() < lim {
+		lim = b.nrec()
+	}
+	i := 0
+	for ; i < lim && a.ha[i] == b.ha[i]; i++ {
+	}
+	a.dstart, b.dstart = i, i
+	lim -= i
+	i = 0
+	for ; i < lim && a.ha[a.nrec()-1-i] == b.ha[b.nrec()-1-i]; i++ {
+	}
+	a.dend = a.nrec() - i - 1
+	b.dend = b.nrec() - i - 1
+}
+
+// cleanupRecords leaves out the lines which do not appear on the other
+// side, and the lines appearing too often among such lines, marking them
+// changed in advance.
+func (d *lineDiff) cleanupRecords() {
+	sides := []struct {
+		f     *diffFile
+		other []int
+	}{{d.a, d.count2}, {d.b, d.count1}}
+	for _, side := range sides {
+		f := side.f
+		dis := make([]byte, f.nrec()+1)
+		mlim := bogosqrt(f.nrec())
+		if mlim > xdlMaxEqLimit {
+			mlim = xdlMaxEqLimit
+		}
+		for i := f.dstart; i <= f.dend; i++ {
+			switch nm := side.other[f.ha[i]]; {
+			case nm == 0:
+				dis[i] = 0
+			case nm >= mlim:
+				dis[i] = 2
+			default:
+				dis[i] = 1
+			}
+		}
+		for i := f.dstart; i <= f.dend; i++ {
+			if dis[i] == 1 || dis[i] == 2 && !cleanMatch(dis, i, f.dstart, f.dend) {
+				f.rindex = append(f.rindex, i)
+				f.rha = append(f.rha, f.ha[i])
+			} else {
+				f.setChanged(i, true)
+			}
+		}
+	}
+}
+
+// cleanMatch reports whether the line i with many matches should be left
+// out, being in the middle of lines without any match.
+func cleanMatch(dis []byte, i, s, e int) bool {
+	if i-s > xdlSimscanWindow {
+		s = i - xdlSimscanWindow
+	}
+	if e-i > xdlSimscanWindow {
+		e = i + xdlSimscanWindow
+	}
+	rdis0, rpdis0 := 0, 1
+	for r := 1; i-r >= s; r++ {
+		if dis[i-r] == 0 {
+			rdis0++
+		} else if dis[i-r] == 2 {
+			rpdis0++
+		} else {
+			break
+		}
+	}
+	if rdis0 == 0 {
+		return false
+	}
+	rdis1, rpdis1 := 0, 1
+	for r := 1; i+r <= e; r++ {
+		if dis[i+r] == 0 {
+			rdis1++
+		} else if dis[i+r] == 2 {
+			rpdis1++
+		} else {
+			break
+		}
+	}
+	if rdis1 == 0 {
+		return false
+	}
+	rdis1 += rdis0
+	rpdis1 += rpdis0
+	return rpdis1*xdlKpdisRun < rpdis1+rdis1
+}
+
+func bogosqrt(n int) int {
+	i := 1
+	for ; n > 0; n >>= 2 {
+		i <<= 1
+	}
+	return i
+}
+
+type myersDiff struct {
+	a, b       *diffFile
+	kvdf, kvdb []int
+	// off is the index of the diagonal zero in kvdf and kvdb
+	off    int
+	mxcost int
+}
+
+// compare marks the changed lines between the records off1 to lim1 and
+// off2 to lim2 left by cleanupRecords, dividing them at a middle snake.
+func (m *myersDiff) compare(off1, lim1, off2, lim2 int, minimal bool) {
+	ha1, ha2 := m.a.rha, m.b.rha
+	for off1 < lim1 && off2 < lim2 && ha1[off1] == ha2[off2] {
+		off1++
+		off2++
+	}
+	for off1 < lim1 && off2 < lim2 && ha1[lim1-1] == ha2[lim2-1] {
+		lim1--
+		lim2--
+	}
+	switch {
+	case off1 == lim1:
+		for ; off2 < lim2; off2++ {
+			m.b.setChanged(m.b.rindex[off2], true)
+		}
+	case off2 == lim2:
+		for ; off1 < lim1; off1++ {
+			m.a.setChanged(m.a.rindex[off1], true)
+		}
+	default:
+		i1, i2, minLo, minHi := m.split(off1, lim1, off2, lim2, minimal)
+		m.compare(off1, i1, off2, i2, minLo)
+		m.compare(i1, lim1, i2, lim2, minHi)
+	}
+}
+
+// split finds where to divide the box like xdl_split, returning the split
+// point and whether each half must be compared minimally.
+func (m *myersDiff) split(off1, lim1, off2, lim2 int, minimal bool) (int, int, bool, bool) {
+	ha1, ha2 := m.a.rha, m.b.rha
+	kvdf, kvdb, o := m.kvdf, m.kvdb, m.off
+	dmin, dmax := off1-lim2, lim1-off2
+	fmid, bmid := off1-off2, lim1-lim2
+	odd := (fmid-bmid)&1 != 0
+	fmin, fmax := fmid, fmid
+	bmin, bmax := bmid, bmid
+
+	kvdf[o+fmid] = off1
+	kvdb[o+bmid] = lim1
+
+	for ec := 1; ; ec++ {
+		gotSnake := false
+
+		if fmin > dmin {
+			fmin--
+			kvdf[o+fmin-1] = -1
+		} else {
+			fmin++
+		}
+		if fmax < dmax {
+			fmax++
+			kvdf[o+fmax+1] = -1
+		} else {
+			fmax--
+		}
+		for d := fmax; d >= fmin; d -= 2 {
+			var i1 int
+			if kvdf[o+d-1] >= kvdf[o+d+1] {
+				i1 = kvdf[o+d-1] + 1
+			} else {
+				i1 = kvdf[o+d+1]
+			}
+			prev1 := i1
+			i2 := i1 - d
+			for ; i1 < lim1 && i2 < lim2 && ha1[i1] == ha2[i2]; i1, i2 = i1+1, i2+1 {
+			}
+			if i1-prev1 > xdlSnakeCnt {
+				gotSnake = true
+			}
+			kvdf[o+d] = i1
+			if odd && bmin <= d && d <= bmax && kvdb[o+d] <= i1 {
+				return i1, i2, true, true
+			}
+		}
+
+		if bmin > dmin {
+			bmin--
+			kvdb[o+bmin-1] = math.MaxInt
+		} else {
+			bmin++
+		}
+		if bmax < dmax {
+			bmax++
+			kvdb[o+bmax+1] = math.MaxInt
+		} else {
+			bmax--
+		}
+		for d := bmax; d >= bmin; d -= 2 {
+			var i1 int
+			if kvdb[o+d-1] < kvdb[o+d+1] {
+				i1 = kvdb[o+d-1]
+			} else {
+				i1 = kvdb[o+d+1] - 1
+			}
+			prev1 := i1
+			i2 := i1 - d
+			for ; i1 > off1 && i2 > off2 && ha1[i1-1] == ha2[i2-1]; i1, i2 = i1-1, i2-1 {
+			}
+			if prev1-i1 > xdlSnakeCnt {
+				gotSnake = true
+			}
+			kvdb[o+d] = i1
+			if !odd && fmin <= d && d <= fmax && i1 <= kvdf[o+d] {
+				return i1, i2, true, true
+			}
+		}
+
+		if minimal {
+			continue
+		}
+
+		// with a good snake past the heuristic cost, take the diagonal
+		// which has gone furthest from its corner
+		if gotSnake && ec > xdlHeurMinCost {
+			best, si1, si2 := 0, 0, 0
+			for d := fmax; d >= fmin; d -= 2 {
+				dd := d - fmid
+				if dd < 0 {
+					dd = -dd
+				}
+				i1 := kvdf[o+d]
+				i2 := i1 - d
+				v := (i1 - off1) + (i2 - off2) - dd
+				if v > xdlKHeur*ec && v > best &&
+					off1+xdlSnakeCnt <= i1 && i1 < lim1 &&
+					off2+xdlSnakeCnt <= i2 && i2 < lim2 {
+					for k := 1; ha1[i1-k] == ha2[i2-k]; k++ {
+						if k == xdlSnakeCnt {
+							best, si1, si2 = v, i1, i2
+							break
+						}
+					}
+				}
+			}
+			if best > 0 {
+				return si1, si2, true, false
+			}
+			for d := bmax; d >= bmin; d -= 2 {
+				dd := d - bmid
+				if dd < 0 {
+					dd = -dd
+				}
+				i1 := kvdb[o+d]
+				i2 := i1 - d
+				v := (lim1 - i1) + (lim2 - i2) - dd
+				if v > xdlKHeur*ec && v > best &&
+					off1 < i1 && i1 <= lim1-xdlSnakeCnt &&
+					off2 < i2 && i2 <= lim2-xdlSnakeCnt {
+					for k := 0; ha1[i1+k] == ha2[i2+k]; k++ {
+						if k == xdlSnakeCnt-1 {
+							best, si1, si2 = v, i1, i2
+							break
+						}
+					}
+				}
+			}
+			if best > 0 {
+				return si1, si2, false, true
+			}
+		}
+
+		// enough is enough, take the furthest reaching path
+		if ec >= m.mxcost {
+			fbest, fbest1 := -1, -1
+			for d := fmax; d >= fmin; d -= 2 {
+				i1 := kvdf[o+d]
+				if i1 > lim1 {
+					i1 = lim1
+				}
+				i2 := i1 - d
+				if lim2 < i2 {
+					i1, i2 = lim2+d, lim2
+				}
+				if fbest < i1+i2 {
+					fbest, fbest1 = i1+i2, i1
+				}
+			}
+			bbest, bbest1 := math.MaxInt, math.MaxInt
+			for d := bmax; d >= bmin; d -= 2 {
+				i1 := kvdb[o+d]
+				if i1 < off1 {
+					i1 = off1
+				}
+				i2 := i1 - d
+				if i2 < off2 {
+					i1, i2 = off2+d, off2
+				}
+				if i1+i2 < bbest {
+					bbest, bbest1 = i1+i2, i1
+				}
+			}
+			if (lim1+lim2)-bbest < fbest-(off1+off2) {
+				return fbest1, fbest - fbest1, true, false
+			}
+			return bbest1, bbest - bbest1, false, true
+		}
+	}
+}
+
+// fallback diffs the lines line1 to line1+count1-1 and line2 to
+// line2+count2-1, counted from one, by Myers as its own files.
+func (d *lineDiff) fallback(line1, count1, line2, count2 int) {
+	sub := newLineDiffLines(d.a.recs[line1-1:line1-1+count1], d.b.recs[line2-1:line2-1+count2])
+	sub.myers(false)
+	copy(d.a.rchg[line1:line1+count1], sub.a.rchg[1:])
+	copy(d.b.rchg[line2:line2+count2], sub.b.rchg[1:])
+}
+
+func (d *lineDiff) markAll(line1, count1, line2, count2 int) {
+	for ; count1 > 0; count1-- {
+		d.a.setChanged(line1-1, true)
+		line1++
+	}
+	for ; count2 > 0; count2-- {
+		d.b.setChanged(line2-1, true)
+		line2++
+	}
+}
+
+type patienceEntry struct {
+	line1, line2 int
+	next, prev   *patienceEntry
+}
+
+// patience matches the lines unique to both ranges in their longest
+// common sequence and recurses between them, like xpatience.c. Lines are
+// counted from one.
+func (d *lineDiff) patience(line1, count1, line2, count2 int) {
+	if count1 == 0 || count2 == 0 {
+		d.markAll(line1, count1, line2, count2)
+		return
+	}
+
+	// line2 is -1 for a line not unique on either side
+	entries := make(map[int]*patienceEntry)
+	var order []*patienceEntry
+	for l := line1; l < line1+count1; l++ {
+		if e, ok := entries[d.a.ha[l-1]]; ok {
+			e.line2 = -1
+			continue
+		}
+		e := &patienceEntry{line1: l}
+		entries[d.a.ha[l-1]] = e
+		order = append(order, e)
+	}
+	hasMatches := false
+	for l := line2; l < line2+count2; l++ {
+		e, ok := entries[d.b.ha[l-1]]
+		if !ok {
+			continue
+		}
+		hasMatches = true
+		if e.line2 != 0 {
+			e.line2 = -1
+		} else {
+			e.line2 = l
+		}
+	}
+	if !hasMatches {
+		d.markAll(line1, count1, line2, count2)
+		return
+	}
+
+	// sequence holds the entry ending the sequence of each length with
+	// the smallest line2
+	sequence := make([]*patienceEntry, len(order))
+	longest := 0
+	for _, e := range order {
+		if e.line2 <= 0 {
+			continue
+		}
+		left, right := -1, longest
+		for left+1 < right {
+			middle := left + (right-left)/2
+			if sequence[middle].line2 > e.line2 {
+				right = middle
+			} else {
+				left = middle
+			}
+		}
+		e.prev = nil
+		if left >= 0 {
+			e.prev = sequence[left]
+		}
+		sequence[left+1] = e
+		if left+1 == longest {
+			longest++
+		}
+	}
+	if longest == 0 {
+		d.fallback(line1, count1, line2, count2)
+		return
+	}
+	first := sequence[longest-1]
+	first.next = nil
+	for first.prev != nil {
+		first.prev.next = first
+		first = first.prev
+	}
+
+	match := func(l1, l2 int) bool { return d.a.ha[l1-1] == d.b.ha[l2-1] }
+	end1, end2 := line1+count1, line2+count2
+	for {
+		var next1, next2 int
+		if first != nil {
+			next1, next2 = first.line1, first.line2
+			for next1 > line1 && next2 > line2 && match(next1-1, next2-1) {
+				next1--
+				next2--
+			}
+		} else {
+			next1, next2 = end1, end2
+		}
+		for line1 < next1 && line2 < next2 && match(line1, line2) {
+			line1++
+			line2++
+		}
+		if next1 > line1 || next2 > line2 {
+			d.patience(line1, next1-line1, line2, next2-line2)
+		}
+		if first == nil {
+			return
+		}
+		for first.next != nil && first.next.line1 == first.line1+1 && first.next.line2 == first.line2+1 {
+			first = first.next
+		}
+		line1, line2 = first.line1+1, first.line2+1
+		first = first.next
+	}
+}
+
+type histogramRecord struct {
+	ptr, cnt int
+}
+
+type lineRegion struct {
+	begin1, end1 int
+	begin2, end2 int
+}
+
+// histogram splits the ranges at the longest common run of lines which
+// occur the least often, like xhistogram.c. Lines are counted from one.
+func (d *lineDiff) histogram(line1, count1, line2, count2 int) {
+	for {
+		if count1 <= 0 && count2 <= 0 {
+			return
+		}
+		if count1 == 0 || count2 == 0 {
+			d.markAll(line1, count1, line2, count2)
+			return
+		}
+		lcs, fallback := d.findLCS(line1, count1, line2, count2)
+		if fallback {
+			d.fallback(line1, count1, line2, count2)
+			return
+		}
+		if lcs.begin1 == 0 && lcs.begin2 == 0 {
+			d.markAll(line1, count1, line2, count2)
+			return
+		}
+		d.histogram(line1, lcs.begin1-line1, line2, lcs.begin2-line2)
+		count1 = line1 + count1 - 1 - lcs.end1
+		line1 = lcs.end1 + 1
+		count2 = line2 + count2 - 1 - lcs.end2
+		line2 = lcs.end2 + 1
+	}
+}
+
+// findLCS finds the longest common run of lines with the fewest
+// occurrences in the old range, or reports that Myers should be used
+// since every common line occurs too often.
+func (d *lineDiff) findLCS(line1, count1, line2, count2 int) (lineRegion, bool) {
+	end1, end2 := line1+count1-1, line2+count2-1
+	records := make(map[int]*histogramRecord)
+	lineMap := make([]*histogramRecord, count1)
+	// nextPtr links the lines of the same class, zero at the last one
+	nextPtr := make([]int, count1)
+	for ptr := end1; ptr >= line1; ptr-- {
+		c := d.a.ha[ptr-1]
+		if rec, ok := records[c]; ok {
+			nextPtr[ptr-line1] = rec.ptr
+			rec.ptr = ptr
+			rec.cnt++
+			lineMap[ptr-line1] = rec
+			continue
+		}
+		rec := &histogramRecord{ptr: ptr, cnt: 1}
+		records[c] = rec
+		lineMap[ptr-line1] = rec
+	}
+
+	var lcs lineRegion
+	cnt := histogramMaxChain + 1
+	hasCommon := false
+	for bPtr := line2; bPtr <= end2; {
+		bNext := bPtr + 1
+		rec := records[d.b.ha[bPtr-1]]
+		switch {
+		case rec == nil:
+		case rec.cnt > cnt:
+			hasCommon = true
+		default:
+			hasCommon = true
+			as := rec.ptr
+			for {
+				np := nextPtr[as-line1]
+				bs, ae := bPtr, as
+				be := bs
+				rc := rec.cnt
+				for line1 < as && line2 < bs && d.a.ha[as-2] == d.b.ha[bs-2] {
+					as--
+					bs--
+					if 1 < rc && lineMap[as-line1].cnt < rc {
+						rc = lineMap[as-line1].cnt
+					}
+				}
+				for ae < end1 && be < end2 && d.a.ha[ae] == d.b.ha[be] {
+					ae++
+					be++
+					if 1 < rc && lineMap[ae-line1].cnt < rc {
+						rc = lineMap[ae-line1].cnt
+					}
+				}
+				if bNext <= be {
+					bNext = be + 1
+				}
+				if lcs.end1-lcs.begin1 < ae-as || rc < cnt {
+					lcs = lineRegion{begin1: as, end1: ae, begin2: bs, end2: be}
+					cnt = rc
+				}
+				for np != 0 && np <= ae {
+					np = nextPtr[np-line1]
+				}
+				if np == 0 {
+					break
+				}
+				as = np
+			}
+		}
+		bPtr = bNext
+	}
+	return lcs, hasCommon && histogramMaxChain < cnt
+}
+
+// compact slides each group of changed lines in f as far as possible and
+// then back to line up with changes in other, or to the position the
+// indent heuristic prefers, like xdl_change_compact.
+func (d *lineDiff) compact(f, other *diffFile) {
+	g := newLineGroup(f)
+	og := newLineGroup(other)
+	for {
+		if g.end != g.start {
+			var earliestEnd, endMatchingOther, groupsize int
+			for {
+				groupsize = g.end - g.start
+				endMatchingOther = -1
+				for g.slideUp(f) {
+					og.previous(other)
+				}
+				earliestEnd = g.end
+				if og.end > og.start {
+					endMatchingOther = g.end
+				}
+				for g.slideDown(f) {
+					og.next(other)
+					if og.end > og.start {
+						endMatchingOther = g.end
+					}
+				}
+				if groupsize == g.end-g.start {
+					break
+				}
+			}
+
+			switch {
+			case g.end == earliestEnd:
+			case endMatchingOther != -1:
+				for og.end == og.start {
+					g.slideUp(f)
+					og.previous(other)
+				}
+			default:
+				shift := earliestEnd
+				if g.end-groupsize-1 > shift {
+					shift = g.end - groupsize - 1
+				}
+				if g.end-indentHeuristicMaxSliding > shift {
+					shift = g.end - indentHeuristicMaxSliding
+				}
+				bestShift := -1
+				var best splitScore
+				for ; shift <= g.end; shift++ {
+					var score splitScore
+					score.add(measureSplit(f, shift))
+					score.add(measureSplit(f, shift-groupsize))
+					if bestShift == -1 || score.cmp(best) <= 0 {
+						best, bestShift = score, shift
+					}
+				}
+				for g.end > bestShift {
+					g.slideUp(f)
+					og.previous(other)
+				}
+			}
+		}
+		if !g.next(f) {
+			break
+		}
+		og.next(other)
+	}
+}
+
+// lineGroup is a run of changed lines, which may be empty.
+type lineGroup struct {
+	start, end int
+}
+
+func newLineGroup(f *diffFile) *lineGroup {
+	g := new(lineGroup)
+	for f.changed(g.end) {
+		g.end++
+	}
+	return g
+}
+
+func (g *lineGroup) next(f *diffFile) bool {
+	if g.end == f.nrec() {
+		return false
+	}
+	g.start = g.end + 1
+	for g.end = g.start; f.changed(g.end); g.end++ {
+	}
+	return true
+}
+
+func (g *lineGroup) previous(f *diffFile) bool {
+	if g.start == 0 {
+		return false
+	}
+	g.end = g.start - 1
+	for g.start = g.end; f.changed(g.start - 1); g.start-- {
+	}
+	return true
+}
+
+func (g *lineGroup) slideDown(f *diffFile) bool {
+	if g.end < f.nrec() && f.ha[g.start] == f.ha[g.end] {
+		f.setChanged(g.start, false)
+		f.setChanged(g.end, true)
+		g.start++
+		g.end++
+		for f.changed(g.end) {
+			g.end++
+		}
+		return true
+	}
+	return false
+}
+
+func (g *lineGroup) slideUp(f *diffFile) bool {
+	if g.start > 0 && f.ha[g.start-1] == f.ha[g.end-1] {
+		g.start--
+		g.end--
+		f.setChanged(g.start, true)
+		f.setChanged(g.end, false)
+		for f.changed(g.start - 1) {
+			g.start--
+		}
+		return true
+	}
+	return false
+}
+
+const (
+	indentHeuristicMaxSliding = 100
+	maxIndent                 = 200
+	maxBlanks                 = 20
+
+	startOfFilePenalty              = 1
+	endOfFilePenalty                = 21
+	totalBlankWeight                = -30
+	postBlankWeight                 = 6
+	relativeIndentPenalty           = -4
+	relativeIndentWithBlankPenalty  = 10
+	relativeOutdentPenalty          = 24
+	relativeOutdentWithBlankPenalty = 17
+	relativeDedentPenalty           = 23
+	relativeDedentWithBlankPenalty  = 17
+	indentWeight                    = 60
+)
+
+type splitMeasurement struct {
+	endOfFile  bool
+	indent     int
+	preBlank   int
+	preIndent  int
+	postBlank  int
+	postIndent int
+}
+
+// lineIndent returns the indent width of line with tabs to multiples of 8,
+// or -1 for a blank line.
+func lineIndent(line []byte) int {
+	n := 0
+	for _, c := range line {
+		switch c {
+		case ' ':
+			n++
+		case '\t':
+			n += 8 - n%8
+		case '\n', '\r':
+		default:
+			return n
+		}
+		if n >= maxIndent {
+			return maxIndent
+		}
+	}
+	return -1
+}
+
+func measureSplit(f *diffFile, split int) splitMeasurement {
+	var m splitMeasurement
+	if split >= f.nrec() {
+		m.endOfFile = true
+		m.indent = -1
+	} else {
+		m.indent = lineIndent(f.recs[split])
+	}
+	m.preIndent = -1
+	for i := split - 1; i >= 0; i-- {
+		if m.preIndent = lineIndent(f.recs[i]); m.preIndent != -1 {
+			break
+		}
+		if m.preBlank++; m.preBlank == maxBlanks {
+			m.preIndent = 0
+			break
+		}
+	}
+	m.postIndent = -1
+	for i := split + 1; i < f.nrec(); i++ {
+		if m.postIndent = lineIndent(f.recs[i]); m.postIndent != -1 {
+			break
+		}
+		if m.postBlank++; m.postBlank == maxBlanks {
+			m.postIndent = 0
+			break
+		}
+	}
+	return m
+}
+
+type splitScore struct {
+	effectiveIndent int
+	penalty         int
+}
+
+func (s *splitScore) add(m splitMeasurement) {
+	if m.preIndent == -1 && m.preBlank == 0 {
+		s.penalty += startOfFilePenalty
+	}
+	if m.endOfFile {
+		s.penalty += endOfFilePenalty
+	}
+	postBlank := 0
+	if m.indent == -1 {
+		postBlank = 1 + m.postBlank
+	}
+	totalBlank := m.preBlank + postBlank
+	s.penalty += totalBlankWeight * totalBlank
+	s.penalty += postBlankWeight * postBlank
+	indent := m.indent
+	if indent == -1 {
+		indent = m.postIndent
+	}
+	anyBlanks := totalBlank != 0
+	s.effectiveIndent += indent
+	switch {
+	case indent == -1, m.preIndent == -1, indent == m.preIndent:
+	case indent > m.preIndent:
+		if anyBlanks {
+			s.penalty += relativeIndentWithBlankPenalty
+		} else {
+			s.penalty += relativeIndentPenalty
+		}
+	case m.postIndent != -1 && m.postIndent > indent:
+		if anyBlanks {
+			s.penalty += relativeOutdentWithBlankPenalty
+		} else {
+			s.penalty += relativeOutdentPenalty
+		}
+	default:
+		if anyBlanks {
+			s.penalty += relativeDedentWithBlankPenalty
+		} else {
+			s.penalty += relativeDedentPenalty
+		}
+	}
+}
+
+func (s splitScore) cmp(t splitScore) int {
+	c := 0
+	if s.effectiveIndent > t.effectiveIndent {
+		c = 1
+	} else if s.effectiveIndent < t.effectiveIndent {
+		c = -1
+	}
+	return indentWeight*c + s.penalty - t.penalty
+}
@@ -0,0 +1,117 @@
+package git
+
+import (
+	"sort"
+	"strings"
+)
+
+// LogPath returns the commits reachable from id which changed path, most
+// recent first. History is simplified like git log -- path: a merge is
+// followed only through a parent it took the path from unchanged, and is
+// not shown then.
+func (r *Repository) LogPath(id SHA1, path string) ([]*Commit, error) {
+	path = strings.Trim(path, "/")
+	start := newCommit(id, r)
+	if err := start.Resolve(); err != nil {
+		return nil, err
+	}
+
+	var (
+		out   []*Commit
+		queue = []*Commit{start}
+		seen  = map[SHA1]bool{id: true}
+		graph = r.commitGraph()
+	)
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		parents, changed, err := r.pathParents(c, path, graph)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range parents {
+			if seen[p.id] {
+				continue
+			}
+			seen[p.id] = true
+			if err := p.Resolve(); err != nil {
+				return nil, err
+			}
+			queue = insertByDate(queue, p)
+		}
+		if changed {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// pathParents returns the parents of c to follow for the history of path
+// and whether c changed it. The first parent with the same path is the only
+// one followed, and c changed the path if there is none. Changed-path
+// filters tell that the first parent has the same path without comparing
+// trees.
+func (r *Repository) pathParents(c *Commit, path string, graph *CommitGraph) ([]*Commit, bool, error) {
+	if graph != nil && !c.IsRoot() {
+		if filter := graph.BloomFilter(c.id); filter != nil {
+			for key := path; key != ""; key = parentPath(key) {
+				if maybe, ok := filter.MaybeContains(key); ok && !maybe {
+					return c.Parents[:1], false, nil
+				}
+			}
+		}
+	}
+
+	e, err := treeEntryAt(c.Tree, path)
+	if err != nil {
+		return nil, false, err
+	}
+	if c.IsRoot() {
+		return nil, e != nil, nil
+	}
+	for _, parent := range c.Parents {
+		if err = parent.Resolve(); err != nil {
+			return nil, false, err
+		}
+		pe, err := treeEntryAt(parent.Tree, path)
+		if err != nil {
+			return nil, false, err
+		}
+		if sameTreeEntry(e, pe) {
+			return []*Commit{parent}, false, nil
+		}
+	}
+	return c.Parents, true, nil
+}
+
+func sameTreeEntry(a, b *TreeEntry) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Mode == b.Mode && a.Object.SHA1() == b.Object.SHA1()
+}
+
+func treeEntryAt(tree *Tree, path string) (*TreeEntry, error) {
+	e, err := tree.entry(strings.Split(path, "/"))
+	if err == ErrObjectNotFound {
+		return nil, nil
+	}
+	return e, err
+}
+
+func parentPath(path string) string {
+	if pos := strings.LastIndex(path, "/"); pos != -1 {
+		return path[:pos]
+	}
+	return ""
+}
+
+func insertByDate(queue []*Commit, c *Commit) []*Commit {
+	x := sort.Search(len(queue), func(i int) bool {
+		return queue[i].Committer.Date.Before(c.Committer.Date)
+	})
+	queue = append(queue, nil)
+	copy(queue[x+1:], queue[x:])
+	queue[x] = c
+	return queue
+}
@@ -6,13 +6,15 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 )
 
 type looseObjectEntry struct {
-	f   *os.File
-	zr  io.ReadCloser
-	br  *bufio.Reader
-	typ string
+	f    *os.File
+	zr   io.ReadCloser
+	br   *bufio.Reader
+	typ  string
+	size int64
 }
 
 func newLooseObjectEntry(root string, id SHA1) (*looseObjectEntry, error) {
@@ -41,10 +43,14 @@ func newLooseObjectEntry(root string, id SHA1) (*looseObjectEntry, error) {
 	}
 	e.typ = string(bs[:len(bs)-1])
 
-	if _, err = e.br.ReadBytes(0); err != nil {
+	if bs, err = e.br.ReadBytes(0); err != nil {
 		e.Close()
 		return nil, err
 	}
+	if e.size, err = strconv.ParseInt(string(bs[:len(bs)-1]), 10, 64); err != nil {
+		e.Close()
+		return nil, ErrUnknownFormat
+	}
 	return e, nil
 }
 
@@ -0,0 +1,272 @@
+package git
+
+import (
+	"math"
+	"sort"
+)
+
+// generationInfinity is the generation of commits missing from the
+// commit-graph, which may be the child of any commit in it.
+const generationInfinity = math.MaxUint32
+
+const (
+	paintParent1 = 1 << iota
+	paintParent2
+	paintStale
+	paintResult
+)
+
+// MergeBase returns the best common ancestors of a and any of b like
+// git merge-base --all. None of them is an ancestor of another.
+func (r *Repository) MergeBase(a SHA1, b ...SHA1) ([]SHA1, error) {
+	one, err := r.commitOf(a)
+	if err != nil {
+		return nil, err
+	}
+	twos, err := r.commitsOf(b)
+	if err != nil {
+		return nil, err
+	}
+	bases, err := r.mergeBases(one, twos)
+	if err != nil {
+		return nil, err
+	}
+	return commitIDs(bases), nil
+}
+
+// MergeBaseOctopus returns the best common ancestors of all the commits
+// like git merge-base --octopus --all.
+func (r *Repository) MergeBaseOctopus(ids ...SHA1) ([]SHA1, error) {
+	commits, err := r.commitsOf(ids)
+	if err != nil || len(commits) == 0 {
+		return nil, err
+	}
+	result := commits[:1]
+	for _, c := range commits[1:] {
+		var next []*Commit
+		seen := make(map[SHA1]bool)
+		for _, base := range result {
+			bases, err := r.mergeBases(c, []*Commit{base})
+			if err != nil {
+				return nil, err
+			}
+			for _, b := range bases {
+				if !seen[b.id] {
+					seen[b.id] = true
+					next = append(next, b)
+				}
+			}
+		}
+		result = next
+	}
+	return commitIDs(result), nil
+}
+
+// MergeBaseIndependent returns the commits which cannot be reached from
+// any other of them like git merge-base --independent, in the given order.
+func (r *Repository) MergeBaseIndependent(ids ...SHA1) ([]SHA1, error) {
+	commits, err := r.commitsOf(ids)
+	if err != nil {
+		return nil, err
+	}
+	var unique []*Commit
+	seen := make(map[SHA1]bool)
+	for _, c := range commits {
+		if !seen[c.id] {
+			seen[c.id] = true
+			unique = append(unique, c)
+		}
+	}
+	if unique, err = r.removeRedundant(unique); err != nil {
+		return nil, err
+	}
+	return commitIDs(unique), nil
+}
+
+func (r *Repository) commitsOf(ids []SHA1) ([]*Commit, error) {
+	commits := make([]*Commit, len(ids))
+	for i, id := range ids {
+		c, err := r.commitOf(id)
+		if err != nil {
+			return nil, err
+		}
+		commits[i] = c
+	}
+	return commits, nil
+}
+
+func commitIDs(commits []*Commit) []SHA1 {
+	ids := make([]SHA1, len(commits))
+	for i, c := range commits {
+		ids[i] = c.id
+	}
+	return ids
+}
+
+func (r *Repository) mergeBases(one *Commit, twos []*Commit) ([]*Commit, error) {
+	for _, two := range twos {
+		if two.id == one.id {
+			return []*Commit{one}, nil
+		}
+	}
+	bases, err := r.paintDownToCommon(one, twos)
+	if err != nil || len(bases) <= 1 {
+		return bases, err
+	}
+	return r.removeRedundant(bases)
+}
+
+// paintDownToCommon walks down from one and twos at the same time and
+// returns the commits reached from both sides first, most recent first.
+// Some of them may be ancestors of the others.
+func (r *Repository) paintDownToCommon(one *Commit, twos []*Commit) ([]*Commit, error) {
+	flags, result, err := r.paint(one, twos, 0)
+	if err != nil {
+		return nil, err
+	}
+	var bases []*Commit
+	for _, c := range result {
+		if flags[c.id]&paintStale == 0 {
+			bases = append(bases, c)
+		}
+	}
+	sort.Stable(commitsByDate(bases))
+	return bases, nil
+}
+
+// paint marks the commits reachable from one with paintParent1 and those
+// from twos with paintParent2, until every commit still queued is known to
+// be reachable from both. Commits below minGeneration are not walked.
+func (r *Repository) paint(one *Commit, twos []*Commit, minGeneration uint32) (map[SHA1]int, []*Commit, error) {
+	var (
+		flags   = make(map[SHA1]int)
+		commits = make(map[SHA1]*Commit)
+		queue   = newGenerationQueue(r)
+		result  []*Commit
+	)
+	// nonStale counts the queue entries not known to be reachable from both
+	// sides, the walk ends when there are none
+	nonStale := 0
+	push := func(c *Commit, f int) error {
+		if known, ok := commits[c.id]; ok {
+			c = known
+		} else if err := c.Resolve(); err != nil {
+			return err
+		}
+		commits[c.id] = c
+		if flags[c.id]&paintStale == 0 && f&paintStale != 0 {
+			nonStale -= queue.ids[c.id]
+		}
+		flags[c.id] |= f
+		if flags[c.id]&paintStale == 0 {
+			nonStale++
+		}
+		queue.push(c)
+		return nil
+	}
+
+	if err := push(one, paintParent1); err != nil {
+		return nil, nil, err
+	}
+	for _, two := range twos {
+		if err := push(two, paintParent2); err != nil {
+			return nil, nil, err
+		}
+	}
+	for nonStale > 0 {
+		c := queue.pop()
+		if flags[c.id]&paintStale == 0 {
+			nonStale--
+		}
+		if minGeneration > 0 && r.generation(c) < minGeneration {
+			break
+		}
+		f := flags[c.id] & (paintParent1 | paintParent2 | paintStale)
+		if f == paintParent1|paintParent2 {
+			if flags[c.id]&paintResult == 0 {
+				flags[c.id] |= paintResult
+				result = append(result, c)
+			}
+			f |= paintStale
+		}
+		for _, p := range c.Parents {
+			if flags[p.id]&f == f {
+				continue
+			}
+			if err := push(p, f); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return flags, result, nil
+}
+
+// removeRedundant drops the commits reachable from another one of them,
+// keeping the order of the rest.
+func (r *Repository) removeRedundant(commits []*Commit) ([]*Commit, error) {
+	redundant := make([]bool, len(commits))
+	for i, c := range commits {
+		if redundant[i] {
+			continue
+		}
+		var (
+			others []*Commit
+			index  []int
+		)
+		minGeneration := r.generation(c)
+		for j, other := range commits {
+			if j == i || redundant[j] {
+				continue
+			}
+			others = append(others, other)
+			index = append(index, j)
+			if gen := r.generation(other); gen < minGeneration {
+				minGeneration = gen
+			}
+		}
+		if minGeneration == generationInfinity {
+			minGeneration = 0
+		}
+		flags, _, err := r.paint(c, others, minGeneration)
+		if err != nil {
+			return nil, err
+		}
+		if flags[c.id]&paintParent2 != 0 {
+			redundant[i] = true
+		}
+		for k, other := range others {
+			if flags[other.id]&paintParent1 != 0 {
+				redundant[index[k]] = true
+			}
+		}
+	}
+	var kept []*Commit
+	for i, c := range commits {
+		if !redundant[i] {
+			kept = append(kept, c)
+		}
+	}
+	return kept, nil
+}
+
+// generation returns the generation number of c from the commit-graph.
+func (r *Repository) generation(c *Commit) uint32 {
+	if graph := r.commitGraph(); graph != nil {
+		if gen, ok := graph.Generation(c.id); ok && gen != 0 {
+			return gen
+		}
+	}
+	return generationInfinity
+}
+
+func newGenerationQueue(r *Repository) *commitQueue {
+	q := newCommitQueue(commitDate)
+	q.gen = r.generation
+	return q
+}
+
+type commitsByDate []*Commit
+
+func (s commitsByDate) Len() int           { return len(s) }
+func (s commitsByDate) Less(i, j int) bool { return s[i].Committer.Date.After(s[j].Committer.Date) }
+func (s commitsByDate) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
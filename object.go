@@ -23,6 +23,14 @@ func newObject(typ string, id SHA1, repo *Repository) Object {
 	panic("Unknown object type: " + typ)
 }
 
+func validObjectType(typ string) bool {
+	switch typ {
+	case "blob", "tree", "commit", "tag":
+		return true
+	}
+	return false
+}
+
 type objectEntry interface {
 	Type() string
 	Reader() io.Reader
@@ -7,9 +7,11 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 )
 
 var packMagic = [4]byte{'P', 'A', 'C', 'K'}
@@ -24,15 +26,16 @@ type PackHeader struct {
 
 type Pack struct {
 	PackHeader
-	f   *os.File
-	idx *PackIndexV2
+	path string
+	f    *os.File
+	idx  *PackIndexV2
 }
 
-func OpenPack(path string) (*Pack, error) {
+func OpenPack(path string, format ObjectFormat) (*Pack, error) {
 	path = filepath.Clean(path)
 	ext := filepath.Ext(path)
 	base := path[:len(path)-len(ext)]
-	idx, err := OpenPackIndex(base + ".idx")
+	idx, err := OpenPackIndex(base+".idx", format)
 	if err != nil {
 		return nil, err
 	}
@@ -41,8 +44,9 @@ func OpenPack(path string) (*Pack, error) {
 		return nil, err
 	}
 	pack := &Pack{
-		f:   f,
-		idx: idx,
+		path: base + ".pack",
+		f:    f,
+		idx:  idx,
 	}
 	err = pack.verify()
 	return pack, err
@@ -135,7 +139,7 @@ func (p *Pack) entryAt(offset int64) (*packEntry, error) {
 		}
 		return &pe, nil
 	case packEntryRefDelta:
-		id, err := readSHA1(br)
+		id, err := readSHA1(br, p.idx.Format)
 		if err != nil {
 			return nil, err
 		}
@@ -162,6 +166,43 @@ func (p *Pack) entryAt(offset int64) (*packEntry, error) {
 	return &pe, nil
 }
 
+// sizeAt returns the size of the object at offset. Only the header of a
+// delta is inflated to read the size of its result.
+func (p *Pack) sizeAt(offset int64) (int64, error) {
+	br := bufio.NewReader(io.NewSectionReader(p.f, offset, 1<<62))
+	header, err := readPackEntryHeader(br)
+	if err != nil {
+		return 0, err
+	}
+	size := header[0].Size0()
+	for i, h := range header[1:] {
+		size |= h.Size() << uint(4+7*i)
+	}
+	switch header[0].Type() {
+	case packEntryOfsDelta:
+		if _, err = readPackEntryHeader(br); err != nil {
+			return 0, err
+		}
+	case packEntryRefDelta:
+		if _, err = readSHA1(br, p.idx.Format); err != nil {
+			return 0, err
+		}
+	default:
+		return size, nil
+	}
+	zr, err := zlib.NewReader(br)
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+	dr := bufio.NewReader(zr)
+	if _, err = deltaHeaderSize(dr); err != nil {
+		return 0, err
+	}
+	n, err := deltaHeaderSize(dr)
+	return int64(n), err
+}
+
 type packEntryType byte
 
 const (
@@ -223,3 +264,102 @@ func readPackEntryHeader(br *bufio.Reader) (header []packEntryHeader, err error)
 		}
 	}
 }
+
+type packRawEntry struct {
+	id     SHA1
+	offset int64
+	end    int64
+	data   int64
+	typ    packEntryType
+	size   int64
+	base   SHA1
+	crc    CRC32
+}
+
+// rawEntries describes how every object is stored in the pack so that its
+// compressed data can be copied into another pack as is.
+func (p *Pack) rawEntries() (map[SHA1]*packRawEntry, error) {
+	fi, err := p.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*packRawEntry, len(p.idx.Objects))
+	byOffset := make(map[int64]*packRawEntry)
+	for i, id := range p.idx.Objects {
+		entries[i] = &packRawEntry{
+			id:     id,
+			offset: p.idx.offset(i),
+			crc:    p.idx.CRC32s[i],
+		}
+		byOffset[entries[i].offset] = entries[i]
+	}
+	sorted := append([]*packRawEntry(nil), entries...)
+	sort.Sort(packRawEntriesByOffset(sorted))
+	end := fi.Size() - int64(p.idx.Format.Size())
+	for i := len(sorted) - 1; i >= 0; i-- {
+		sorted[i].end = end
+		end = sorted[i].offset
+	}
+
+	out := make(map[SHA1]*packRawEntry)
+	for _, e := range entries {
+		br := bufio.NewReader(io.NewSectionReader(p.f, e.offset, e.end-e.offset))
+		header, err := readPackEntryHeader(br)
+		if err != nil {
+			return nil, err
+		}
+		e.typ = header[0].Type()
+		e.size = header[0].Size0()
+		for i, h := range header[1:] {
+			e.size |= h.Size() << uint(4+7*i)
+		}
+		n := int64(len(header))
+		switch e.typ {
+		case packEntryOfsDelta:
+			header, err := readPackEntryHeader(br)
+			if err != nil {
+				return nil, err
+			}
+			ofs := header[0].Size()
+			for _, h := range header[1:] {
+				ofs = ((ofs + 1) << 7) + h.Size()
+			}
+			base, ok := byOffset[e.offset-ofs]
+			if !ok {
+				return nil, ErrInvalidDelta
+			}
+			e.base = base.id
+			n += int64(len(header))
+		case packEntryRefDelta:
+			if e.base, err = readSHA1(br, p.idx.Format); err != nil {
+				return nil, err
+			}
+			n += int64(p.idx.Format.Size())
+		}
+		e.data = e.offset + n
+		out[e.id] = e
+	}
+	return out, nil
+}
+
+func (p *Pack) readRawEntry(e *packRawEntry) ([]byte, error) {
+	buf := make([]byte, e.end-e.offset)
+	if _, err := p.f.ReadAt(buf, e.offset); err != nil {
+		return nil, err
+	}
+	if crc := crc32.ChecksumIEEE(buf); CRC32(crc32Bytes(crc)) != e.crc {
+		return nil, fmt.Errorf("CRC mismatch for %s in %s", e.id, p.path)
+	}
+	return buf, nil
+}
+
+type packRawEntriesByOffset []*packRawEntry
+
+func (s packRawEntriesByOffset) Len() int           { return len(s) }
+func (s packRawEntriesByOffset) Less(i, j int) bool { return s[i].offset < s[j].offset }
+func (s packRawEntriesByOffset) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func crc32Bytes(crc uint32) (b [4]byte) {
+	binary.BigEndian.PutUint32(b[:], crc)
+	return
+}
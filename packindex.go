@@ -3,7 +3,6 @@ package git
 import (
 	"bufio"
 	"bytes"
-	"crypto/sha1"
 	"encoding/binary"
 	"errors"
 	"io"
@@ -23,6 +22,7 @@ type PackIndexV2Header struct {
 
 type PackIndexV2 struct {
 	PackIndexV2Header
+	Format        ObjectFormat
 	Objects       []SHA1
 	CRC32s        []CRC32
 	Offsets       []uint32
@@ -32,7 +32,7 @@ type PackIndexV2 struct {
 }
 
 func (idx *PackIndexV2) Parse(r io.Reader) (err error) {
-	hasher := sha1.New()
+	hasher := idx.Format.newHash()
 	r = io.TeeReader(r, hasher)
 
 	if err = binary.Read(r, binary.BigEndian, &idx.PackIndexV2Header); err != nil {
@@ -44,8 +44,10 @@ func (idx *PackIndexV2) Parse(r io.Reader) (err error) {
 
 	total := int(idx.Fanout[255])
 	idx.Objects = make([]SHA1, total, total)
-	if err = binary.Read(r, binary.BigEndian, idx.Objects); err != nil {
-		return
+	for i := range idx.Objects {
+		if idx.Objects[i], err = readSHA1(r, idx.Format); err != nil {
+			return
+		}
 	}
 	idx.CRC32s = make([]CRC32, total, total)
 	if err = binary.Read(r, binary.BigEndian, idx.CRC32s); err != nil {
@@ -67,14 +69,17 @@ func (idx *PackIndexV2) Parse(r io.Reader) (err error) {
 		return
 	}
 
-	if err = binary.Read(r, binary.BigEndian, &idx.PackFileHash); err != nil {
+	if idx.PackFileHash, err = readSHA1(r, idx.Format); err != nil {
+		return
+	}
+	sum, err := checksum(hasher)
+	if err != nil {
 		return
 	}
-	checksum := hasher.Sum(nil)
-	if err = binary.Read(r, binary.BigEndian, &idx.PackIndexHash); err != nil {
+	if idx.PackIndexHash, err = readSHA1(r, idx.Format); err != nil {
 		return
 	}
-	if !bytes.Equal(checksum, idx.PackIndexHash[:]) {
+	if !bytes.Equal(sum, idx.PackIndexHash.Bytes()) {
 		return errors.New("checksum error")
 	}
 	return
@@ -82,22 +87,30 @@ func (idx *PackIndexV2) Parse(r io.Reader) (err error) {
 
 func (idx *PackIndexV2) Entry(id SHA1) *PackIndexEntry {
 	lower := 0
-	if id[0] != 0 {
-		lower = int(idx.Fanout[int(id[0])-1])
+	if id.hash[0] != 0 {
+		lower = int(idx.Fanout[int(id.hash[0])-1])
 	}
-	upper := int(idx.Fanout[int(id[0])])
+	upper := int(idx.Fanout[int(id.hash[0])])
 	entries := idx.Objects[lower:upper]
 	x := sort.Search(len(entries), func(i int) bool {
 		return entries[i].Compare(id) >= 0
 	})
-	if x == len(entries) {
+	if x == len(entries) || entries[x] != id {
 		return nil
 	}
 	x += lower
 	return &PackIndexEntry{
 		ID:     id,
-		Offset: int64(idx.Offsets[x]),
+		Offset: idx.offset(x),
+	}
+}
+
+func (idx *PackIndexV2) offset(i int) int64 {
+	offset := idx.Offsets[i]
+	if offset>>31 == 1 {
+		return int64(idx.LargeOffsets[offset&0x7fffffff])
 	}
+	return int64(offset)
 }
 
 type PackIndexEntry struct {
@@ -105,7 +118,7 @@ type PackIndexEntry struct {
 	Offset int64
 }
 
-func OpenPackIndex(path string) (*PackIndexV2, error) {
+func OpenPackIndex(path string, format ObjectFormat) (*PackIndexV2, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -120,7 +133,7 @@ func OpenPackIndex(path string) (*PackIndexV2, error) {
 	if !bytes.Equal(magic, packIndexV2Magic[:]) {
 		return nil, ErrUnknownFormat
 	}
-	idx := new(PackIndexV2)
+	idx := &PackIndexV2{Format: format}
 	err = idx.Parse(buf)
 	return idx, err
 }
@@ -0,0 +1,140 @@
+package git
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type PackRefsOptions struct {
+	// All packs every ref instead of only tags.
+	All bool
+	// NoPrune keeps the loose refs which have been packed.
+	NoPrune bool
+}
+
+// PackRefs moves loose refs into packed-refs like git pack-refs. Every ref
+// in the rewritten file carries its peeled value when it points to a tag.
+// With reftable, the whole stack is compacted into a single table instead.
+func (r *Repository) PackRefs(opts PackRefsOptions) error {
+	return r.refs.pack(opts)
+}
+
+func (b *filesRefBackend) pack(opts PackRefsOptions) error {
+	r := b.repo
+	lock, err := lockPath(filepath.Join(b.root, "packed-refs"))
+	if err != nil {
+		return err
+	}
+	defer lock.Rollback()
+
+	packed := OpenPackedRefs(b.root)
+	if err = packed.Parse(); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fullyPeeled := packed.HasTrait("fully-peeled")
+	for _, ref := range packed.refs {
+		if ref.Commit == nil && !fullyPeeled {
+			if peeled, ok, err := r.peel(ref.SHA1); err == nil && ok {
+				ref.Commit = &peeled
+			}
+		}
+	}
+
+	loose, err := b.looseRefs()
+	if err != nil {
+		return err
+	}
+	var pack []*Ref
+	for name, ref := range loose {
+		if ref.IsSymbolic() || perWorktreeRef(name) || !(opts.All || strings.HasPrefix(name, "refs/tags/")) {
+			continue
+		}
+		peeled, ok, err := r.peel(ref.SHA1)
+		if err != nil { // broken refs are left alone
+			continue
+		}
+		packedRef := &Ref{Name: name, SHA1: ref.SHA1}
+		if ok {
+			packedRef.Commit = &peeled
+		}
+		packed.refs[name] = packedRef
+		pack = append(pack, ref)
+	}
+
+	packed.Traits = []string{"peeled", "fully-peeled", "sorted"}
+	if err = packed.Write(lock); err != nil {
+		return err
+	}
+	if err = lock.Commit(); err != nil {
+		return err
+	}
+	b.packed = packed
+
+	if opts.NoPrune {
+		return nil
+	}
+	for _, ref := range pack {
+		if err = b.pruneLooseRef(ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneLooseRef removes a loose ref which has been packed, unless it has
+// been changed or locked by someone else in the meantime.
+func (b *filesRefBackend) pruneLooseRef(ref *Ref) error {
+	path := filepath.Join(b.root, ref.Name)
+	lock, err := lockPath(path)
+	if err == ErrRefLocked {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer lock.Rollback()
+	current, err := b.looseRef(ref.Name)
+	if err != nil || current.IsSymbolic() || current.SHA1 != ref.SHA1 {
+		return nil
+	}
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	lock.Rollback()
+	removeEmptyDirs(b.root, filepath.Dir(path))
+	return nil
+}
+
+// peel follows tag objects from id and returns the object finally pointed
+// to. The bool result reports whether id is a tag at all.
+func (r *Repository) peel(id SHA1) (SHA1, bool, error) {
+	tagged := false
+	for {
+		typ, data, err := r.readRaw(id)
+		if err != nil {
+			return id, false, err
+		}
+		if typ != "tag" {
+			return id, tagged, nil
+		}
+		headers := objectHeaders(data)
+		if len(headers) == 0 || headers[0].key != "object" {
+			return id, false, ErrUnknownFormat
+		}
+		if id, err = NewSHA1(headers[0].value); err != nil {
+			return id, false, err
+		}
+		tagged = true
+	}
+}
+
+// perWorktreeRef reports refs which belong to a single worktree and are
+// never packed.
+func perWorktreeRef(name string) bool {
+	for _, prefix := range []string{"refs/bisect/", "refs/worktree/", "refs/rewritten/"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
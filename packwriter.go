@@ -0,0 +1,167 @@
+package git
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+type PackWriter struct {
+	w       io.Writer
+	format  ObjectFormat
+	hasher  hash.Hash
+	offset  int64
+	entries []*packWriterEntry
+	sum     SHA1
+}
+
+type packWriterEntry struct {
+	id     SHA1
+	offset int64
+	crc    uint32
+}
+
+func NewPackWriter(w io.Writer, format ObjectFormat, count uint32) (*PackWriter, error) {
+	pw := &PackWriter{
+		format: format,
+		hasher: format.newHash(),
+	}
+	pw.w = io.MultiWriter(w, pw.hasher)
+	header := PackHeader{Magic: packMagic, Version: 2, Total: count}
+	if err := binary.Write(pw.w, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	pw.offset = 12
+	return pw, nil
+}
+
+func (pw *PackWriter) WriteObject(typ string, data []byte) (SHA1, error) {
+	id, err := HashObject(pw.format, typ, data)
+	if err != nil {
+		return id, err
+	}
+	return id, pw.writeEntry(id, packEntryTypeOf(typ), int64(len(data)), nil, data)
+}
+
+func (pw *PackWriter) writeEntry(id SHA1, typ packEntryType, size int64, prefix, data []byte) error {
+	var buf bytes.Buffer
+	buf.Write(encodePackEntryHeader(typ, size))
+	buf.Write(prefix)
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return pw.writeRaw(id, buf.Bytes())
+}
+
+func (pw *PackWriter) writeRaw(id SHA1, raw []byte) error {
+	if _, err := pw.w.Write(raw); err != nil {
+		return err
+	}
+	pw.entries = append(pw.entries, &packWriterEntry{
+		id:     id,
+		offset: pw.offset,
+		crc:    crc32.ChecksumIEEE(raw),
+	})
+	pw.offset += int64(len(raw))
+	return nil
+}
+
+func (pw *PackWriter) Close() (SHA1, error) {
+	sum, err := checksum(pw.hasher)
+	if err != nil {
+		return pw.sum, err
+	}
+	pw.sum = sha1FromBytes(sum)
+	_, err = pw.w.Write(sum)
+	return pw.sum, err
+}
+
+func (pw *PackWriter) WriteIndex(w io.Writer) error {
+	entries := append([]*packWriterEntry(nil), pw.entries...)
+	sort.Sort(packWriterEntries(entries))
+
+	hasher := pw.format.newHash()
+	w = io.MultiWriter(w, hasher)
+	header := PackIndexV2Header{Magic: packIndexV2Magic, Version: 2}
+	for _, e := range entries {
+		for i := int(e.id.hash[0]); i < 256; i++ {
+			header.Fanout[i]++
+		}
+	}
+	if err := binary.Write(w, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if _, err := w.Write(e.id.Bytes()); err != nil {
+			return err
+		}
+	}
+	for _, e := range entries {
+		if err := binary.Write(w, binary.BigEndian, e.crc); err != nil {
+			return err
+		}
+	}
+	var large []uint64
+	for _, e := range entries {
+		offset := uint32(e.offset)
+		if e.offset >= 1<<31 {
+			offset = 1<<31 | uint32(len(large))
+			large = append(large, uint64(e.offset))
+		}
+		if err := binary.Write(w, binary.BigEndian, offset); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(w, binary.BigEndian, large); err != nil {
+		return err
+	}
+	if _, err := w.Write(pw.sum.Bytes()); err != nil {
+		return err
+	}
+	sum, err := checksum(hasher)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(sum)
+	return err
+}
+
+type packWriterEntries []*packWriterEntry
+
+func (s packWriterEntries) Len() int           { return len(s) }
+func (s packWriterEntries) Less(i, j int) bool { return s[i].id.Compare(s[j].id) < 0 }
+func (s packWriterEntries) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func packEntryTypeOf(typ string) packEntryType {
+	switch typ {
+	case "commit":
+		return packEntryCommit
+	case "tree":
+		return packEntryTree
+	case "blob":
+		return packEntryBlob
+	case "tag":
+		return packEntryTag
+	}
+	return packEntryNone
+}
+
+func encodePackEntryHeader(typ packEntryType, size int64) []byte {
+	b := byte(typ)<<4 | byte(size&0x0f)
+	size >>= 4
+	var out []byte
+	for size > 0 {
+		out = append(out, b|0x80)
+		b = byte(size & 0x7f)
+		size >>= 7
+	}
+	return append(out, b)
+}
@@ -0,0 +1,333 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type PatchOptions struct {
+	Algorithm DiffAlgorithm
+	// Context is the number of unchanged lines shown around changes, 3 if
+	// zero and none if negative.
+	Context int
+}
+
+// WritePatch writes the changes in the unified format of git diff, reading
+// the contents of the files from r. The modes of the changes appear in
+// the headers, and files which look binary are only reported to differ.
+func (r *Repository) WritePatch(w io.Writer, changes []*Change, opts PatchOptions) error {
+	ctx := opts.Context
+	if ctx == 0 {
+		ctx = 3
+	} else if ctx < 0 {
+		ctx = 0
+	}
+	bw := bufio.NewWriter(w)
+	for _, c := range changes {
+		if c.OldMode != 0 && c.NewMode != 0 && c.OldMode&0170000 != c.NewMode&0170000 {
+			// a file replaced by another kind is shown deleted and added
+			del, add := *c, *c
+			del.Type, del.NewPath, del.NewMode, del.NewID = ChangeDelete, c.OldPath, 0, r.Format.zero()
+			add.Type, add.OldPath, add.OldMode, add.OldID = ChangeAdd, c.NewPath, 0, r.Format.zero()
+			if err := r.writeFilePatch(bw, &del, opts.Algorithm, ctx); err != nil {
+				return err
+			}
+			c = &add
+		}
+		if err := r.writeFilePatch(bw, c, opts.Algorithm, ctx); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func (r *Repository) writeFilePatch(w *bufio.Writer, c *Change, algo DiffAlgorithm, ctx int) error {
+	var header bytes.Buffer
+	fmt.Fprintf(&header, "diff --git %s %s\n", quotePathPair("a/", c.OldPath), quotePathPair("b/", c.NewPath))
+	showHeader := true
+	switch {
+	case c.OldMode == 0:
+		fmt.Fprintf(&header, "new file mode %06o\n", c.NewMode)
+	case c.NewMode == 0:
+		fmt.Fprintf(&header, "deleted file mode %06o\n", c.OldMode)
+	case c.OldMode != c.NewMode:
+		fmt.Fprintf(&header, "old mode %06o\nnew mode %06o\n", c.OldMode, c.NewMode)
+	default:
+		showHeader = false
+	}
+	switch c.Type {
+	case ChangeRename, ChangeCopy:
+		verb := "rename"
+		if c.Type == ChangeCopy {
+			verb = "copy"
+		}
+		fmt.Fprintf(&header, "similarity index %d%%\n%s from %s\n%s to %s\n", c.Score, verb, quotePath(c.OldPath), verb, quotePath(c.NewPath))
+		showHeader = true
+	}
+	if c.OldID != c.NewID {
+		fmt.Fprintf(&header, "index %s..%s", r.abbrev(c.OldID), r.abbrev(c.NewID))
+		if c.OldMode == c.NewMode {
+			fmt.Fprintf(&header, " %06o", c.OldMode)
+		}
+		header.WriteByte('\n')
+	}
+
+	old, err := r.patchContents(c.OldMode, c.OldID)
+	if err != nil {
+		return err
+	}
+	new, err := r.patchContents(c.NewMode, c.NewID)
+	if err != nil {
+		return err
+	}
+	oldLabel, newLabel := "/dev/null", "/dev/null"
+	if c.OldMode != 0 {
+		oldLabel = quotePathPair("a/", c.OldPath)
+	}
+	if c.NewMode != 0 {
+		newLabel = quotePathPair("b/", c.NewPath)
+	}
+
+	if isBinary(old) || isBinary(new) {
+		if !bytes.Equal(old, new) {
+			fmt.Fprintf(&header, "Binary files %s and %s differ\n", oldLabel, newLabel)
+			showHeader = true
+		}
+		if showHeader {
+			_, err = w.Write(header.Bytes())
+		}
+		return err
+	}
+
+	if ctx == 0 {
+		old, new = trimCommonTail(old, new)
+	}
+	d := newLineDiff(old, new, algo)
+	changes := d.changes()
+	if len(changes) == 0 {
+		if showHeader {
+			_, err = w.Write(header.Bytes())
+		}
+		return err
+	}
+	w.Write(header.Bytes())
+	fmt.Fprintf(w, "--- %s%s\n+++ %s%s\n", oldLabel, labelTab(oldLabel), newLabel, labelTab(newLabel))
+	writeHunks(w, d, changes, ctx)
+	return nil
+}
+
+// patchContents returns the text compared for a side of a change, which
+// is empty for a missing side and names the commit for a submodule.
+func (r *Repository) patchContents(mode int, id SHA1) ([]byte, error) {
+	switch {
+	case mode == 0:
+		return nil, nil
+	case mode&0170000 == 0160000:
+		return []byte("Subproject commit " + id.String() + "\n"), nil
+	}
+	obj, err := r.Object(id)
+	if err != nil {
+		return nil, err
+	}
+	blob, ok := obj.(*Blob)
+	if !ok {
+		return nil, ErrUnknownFormat
+	}
+	return blob.Data, nil
+}
+
+// labelTab returns the tab git puts after a file label containing spaces.
+func labelTab(label string) string {
+	if strings.IndexByte(label, ' ') != -1 {
+		return "\t"
+	}
+	return ""
+}
+
+// trimCommonTail drops the blocks of 1KiB at the end of both texts which
+// are the same, except for the last partial line, like git does when no
+// context is wanted.
+func trimCommonTail(a, b []byte) ([]byte, []byte) {
+	const blk = 1024
+	smaller := len(a)
+	if len(b) < smaller {
+		smaller = len(b)
+	}
+	trimmed := 0
+	for blk+trimmed <= smaller && bytes.Equal(a[len(a)-trimmed-blk:len(a)-trimmed], b[len(b)-trimmed-blk:len(b)-trimmed]) {
+		trimmed += blk
+	}
+	recovered := 0
+	for recovered < trimmed {
+		recovered++
+		if a[len(a)-trimmed+recovered-1] == '\n' {
+			break
+		}
+	}
+	return a[:len(a)-trimmed+recovered], b[:len(b)-trimmed+recovered]
+}
+
+// writeHunks writes the changes with ctx lines of context around them,
+// joining the changes whose contexts would touch into a hunk. Each hunk
+// header names the nearest line above it in the old text which starts
+// like a function, as git does without a diff driver.
+func writeHunks(w *bufio.Writer, d *lineDiff, changes []LineChange, ctx int) {
+	a, b := d.a.recs, d.b.recs
+	var funcName []byte
+	funcLimit := -1
+	for i := 0; i < len(changes); {
+		j := i
+		for j+1 < len(changes) && changes[j+1].OldStart-(changes[j].OldStart+changes[j].OldLines) <= 2*ctx {
+			j++
+		}
+		first, last := changes[i], changes[j]
+
+		s1, s2 := first.OldStart-ctx, first.NewStart-ctx
+		if s1 < 0 {
+			s1 = 0
+		}
+		if s2 < 0 {
+			s2 = 0
+		}
+		lctx := ctx
+		if n := len(a) - (last.OldStart + last.OldLines); n < lctx {
+			lctx = n
+		}
+		if n := len(b) - (last.NewStart + last.NewLines); n < lctx {
+			lctx = n
+		}
+		e1 := last.OldStart + last.OldLines + lctx
+		e2 := last.NewStart + last.NewLines + lctx
+
+		for l := s1 - 1; l > funcLimit && l < len(a); l-- {
+			if name, ok := funcLine(a[l]); ok {
+				funcName = name
+				break
+			}
+		}
+		funcLimit = s1 - 1
+
+		var header bytes.Buffer
+		header.WriteString("@@ -")
+		writeHunkRange(&header, s1+1, e1-s1)
+		header.WriteString(" +")
+		writeHunkRange(&header, s2+1, e2-s2)
+		header.WriteString(" @@")
+		if len(funcName) > 0 {
+			header.WriteByte(' ')
+			name := funcName
+			if room := 128 - header.Len() - 1; len(name) > room {
+				name = name[:room]
+			}
+			header.Write(name)
+		}
+		header.WriteByte('\n')
+		w.Write(header.Bytes())
+
+		for ; s2 < first.NewStart; s2++ {
+			writePatchLine(w, ' ', b[s2])
+		}
+		for k := i; k <= j; k++ {
+			c := changes[k]
+			if k > i {
+				prev := changes[k-1]
+				l1, l2 := prev.OldStart+prev.OldLines, prev.NewStart+prev.NewLines
+				for ; l1 < c.OldStart && l2 < c.NewStart; l1, l2 = l1+1, l2+1 {
+					writePatchLine(w, ' ', b[l2])
+				}
+			}
+			for l := c.OldStart; l < c.OldStart+c.OldLines; l++ {
+				writePatchLine(w, '-', a[l])
+			}
+			for l := c.NewStart; l < c.NewStart+c.NewLines; l++ {
+				writePatchLine(w, '+', b[l])
+			}
+		}
+		for s2 = last.NewStart + last.NewLines; s2 < e2; s2++ {
+			writePatchLine(w, ' ', b[s2])
+		}
+		i = j + 1
+	}
+}
+
+func writeHunkRange(buf *bytes.Buffer, start, count int) {
+	if count == 0 {
+		start--
+	}
+	fmt.Fprintf(buf, "%d", start)
+	if count != 1 {
+		fmt.Fprintf(buf, ",%d", count)
+	}
+}
+
+func writePatchLine(w *bufio.Writer, prefix byte, line []byte) {
+	w.WriteByte(prefix)
+	w.Write(line)
+	if len(line) > 0 && line[len(line)-1] != '\n' {
+		w.WriteString("\n\\ No newline at end of file\n")
+	}
+}
+
+// funcLine returns line as a hunk header when it starts with a letter,
+// '_' or '$', cut to 80 bytes without trailing spaces.
+func funcLine(line []byte) ([]byte, bool) {
+	if len(line) == 0 {
+		return nil, false
+	}
+	c := line[0]
+	if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '$') {
+		return nil, false
+	}
+	if len(line) > 80 {
+		line = line[:80]
+	}
+	for len(line) > 0 && strings.IndexByte(" \t\n\r", line[len(line)-1]) != -1 {
+		line = line[:len(line)-1]
+	}
+	return line, true
+}
+
+// quotePath quotes a path in double quotes with C-style escapes like git
+// when it contains control characters, quotes, backslashes or non-ASCII
+// bytes.
+func quotePath(name string) string {
+	return quotePathPair("", name)
+}
+
+func quotePathPair(prefix, name string) string {
+	s := prefix + name
+	if !needsQuote(s) {
+		return s
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c >= 0x07 && c <= 0x0d:
+			buf.WriteByte('\\')
+			buf.WriteByte("abtnvfr"[c-0x07])
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&buf, "\\%03o", c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+func needsQuote(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c >= 0x7f || c == '"' || c == '\\' {
+			return true
+		}
+	}
+	return false
+}
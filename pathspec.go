@@ -0,0 +1,155 @@
+package git
+
+import (
+	"path"
+	"strings"
+)
+
+// pathspec selects paths like git pathspecs. A spec without wildcards
+// matches the path itself and everything below it, and a spec with
+// wildcards matches whole paths where '*' also matches '/'. Specs starting
+// with ":!", ":^" or ":(exclude)" exclude the paths they match.
+type pathspec struct {
+	include []string
+	exclude []string
+}
+
+func newPathspec(specs []string) *pathspec {
+	p := new(pathspec)
+	for _, spec := range specs {
+		exclude := false
+		for _, prefix := range []string{":(exclude)", ":!", ":^"} {
+			if strings.HasPrefix(spec, prefix) {
+				spec, exclude = spec[len(prefix):], true
+				break
+			}
+		}
+		spec = strings.TrimPrefix(spec, "./")
+		if spec == "." {
+			spec = ""
+		}
+		if exclude {
+			p.exclude = append(p.exclude, spec)
+		} else {
+			p.include = append(p.include, spec)
+		}
+	}
+	return p
+}
+
+// match reports whether the file at name is selected.
+func (p *pathspec) match(name string) bool {
+	if p == nil {
+		return true
+	}
+	for _, spec := range p.exclude {
+		if matchPathspecItem(spec, name) {
+			return false
+		}
+	}
+	if len(p.include) == 0 {
+		return true
+	}
+	for _, spec := range p.include {
+		if matchPathspecItem(spec, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDir reports whether anything below the directory dir may be
+// selected.
+func (p *pathspec) matchDir(dir string) bool {
+	if p == nil {
+		return true
+	}
+	for _, spec := range p.exclude {
+		if !hasWildcard(spec) && matchPathspecItem(spec, dir) {
+			return false
+		}
+	}
+	if len(p.include) == 0 {
+		return true
+	}
+	for _, spec := range p.include {
+		prefix := strings.TrimSuffix(spec, "/")
+		if i := strings.IndexAny(spec, "*?["); i != -1 {
+			prefix = spec[:i]
+		}
+		// either the directory lies inside the literal part of the spec or
+		// the spec continues inside the directory
+		if strings.HasPrefix(prefix, dir+"/") || prefix == dir || matchPathspecItem(spec, dir) {
+			return true
+		}
+		if hasWildcard(spec) && strings.HasPrefix(dir+"/", prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPathspecItem(spec, name string) bool {
+	if spec == "" {
+		return true
+	}
+	if hasWildcard(spec) {
+		return wildmatch(spec, name)
+	}
+	if strings.HasSuffix(spec, "/") {
+		return strings.HasPrefix(name, spec)
+	}
+	return name == spec || strings.HasPrefix(name, spec+"/")
+}
+
+func hasWildcard(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+// wildmatch matches name against pattern, where '*' and '?' match any
+// character including '/'.
+func wildmatch(pattern, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if wildmatch(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if name == "" {
+				return false
+			}
+			pattern, name = pattern[1:], name[1:]
+		case '[':
+			end := strings.IndexByte(pattern[1:], ']')
+			if name == "" || end == -1 {
+				return false
+			}
+			class := pattern[:end+2]
+			if ok, err := path.Match(class, name[:1]); err != nil || !ok {
+				return false
+			}
+			pattern, name = pattern[end+2:], name[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if name == "" || pattern[0] != name[0] {
+				return false
+			}
+			pattern, name = pattern[1:], name[1:]
+		}
+	}
+	return name == ""
+}
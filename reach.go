@@ -0,0 +1,158 @@
+package git
+
+type AheadBehindCount struct {
+	// Ahead is the number of commits reachable from the tip but not from
+	// the base.
+	Ahead int
+	// Behind is the number of commits reachable from the base but not from
+	// the tip.
+	Behind int
+}
+
+// IsAncestor reports whether a is reachable from b like
+// git merge-base --is-ancestor. A commit is an ancestor of itself.
+func (r *Repository) IsAncestor(a, b SHA1) (bool, error) {
+	one, err := r.commitOf(a)
+	if err != nil {
+		return false, err
+	}
+	two, err := r.commitOf(b)
+	if err != nil {
+		return false, err
+	}
+	if one.id == two.id {
+		return true, nil
+	}
+	// nothing below a can lead to it
+	minGeneration := r.generation(one)
+	if minGeneration == generationInfinity {
+		minGeneration = 0
+	}
+	flags, _, err := r.paint(one, []*Commit{two}, minGeneration)
+	if err != nil {
+		return false, err
+	}
+	return flags[one.id]&paintParent2 != 0, nil
+}
+
+// AheadBehind counts the commits a has which b does not, and the commits b
+// has which a does not, like git rev-list --left-right --count a...b.
+func (r *Repository) AheadBehind(a, b SHA1) (ahead, behind int, err error) {
+	counts, err := r.AheadBehindMany(b, []SHA1{a})
+	if err != nil {
+		return 0, 0, err
+	}
+	return counts[0].Ahead, counts[0].Behind, nil
+}
+
+// AheadBehindMany compares every tip against base in a single walk, e.g. to
+// show how far every branch is from the main one.
+func (r *Repository) AheadBehindMany(base SHA1, tips []SHA1) ([]AheadBehindCount, error) {
+	commits, err := r.commitsOf(append([]SHA1{base}, tips...))
+	if err != nil {
+		return nil, err
+	}
+	return r.aheadBehind(commits)
+}
+
+// aheadBehind walks down from all the commits at once, recording which of
+// them reach each commit in a bitmap. Commits reached by all of them count
+// for no pair, so the walk stops when only such commits are left. Commits
+// are popped in generation order so that each is counted once with all the
+// bits of its descendants. Like git, commits missing from the commit-graph
+// are popped by date instead of walking down to the root commits for their
+// generations, which may miscount across clock skew.
+func (r *Repository) aheadBehind(commits []*Commit) ([]AheadBehindCount, error) {
+	var (
+		width    = len(commits)
+		words    = (width + 63) / 64
+		bitmaps  = make(map[SHA1][]uint64)
+		known    = make(map[SHA1]*Commit)
+		queued   = make(map[SHA1]bool)
+		done     = make(map[SHA1]bool)
+		stale    = make(map[SHA1]bool)
+		queue    = newGenerationQueue(r)
+		counts   = make([]AheadBehindCount, width-1)
+		nonStale = 0
+	)
+	bitmap := func(id SHA1) []uint64 {
+		b := bitmaps[id]
+		if b == nil {
+			b = make([]uint64, words)
+			bitmaps[id] = b
+		}
+		return b
+	}
+	full := func(b []uint64) bool {
+		for i := 0; i < width; i++ {
+			if b[i/64]&(1<<uint(i%64)) == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	push := func(c *Commit) error {
+		if k, ok := known[c.id]; ok {
+			c = k
+		} else if err := c.Resolve(); err != nil {
+			return err
+		}
+		known[c.id] = c
+		isStale := full(bitmap(c.id))
+		if queued[c.id] {
+			if isStale && !stale[c.id] {
+				nonStale--
+			}
+		} else {
+			queued[c.id] = true
+			queue.push(c)
+			if !isStale {
+				nonStale++
+			}
+		}
+		stale[c.id] = isStale
+		return nil
+	}
+
+	for i, c := range commits {
+		bitmap(c.id)[i/64] |= 1 << uint(i%64)
+	}
+	for _, c := range commits {
+		if err := push(c); err != nil {
+			return nil, err
+		}
+	}
+	for nonStale > 0 {
+		c := queue.pop()
+		done[c.id] = true
+		if !stale[c.id] {
+			nonStale--
+		}
+		b := bitmaps[c.id]
+		fromBase := b[0]&1 != 0
+		for i := range counts {
+			tip := i + 1
+			if fromTip := b[tip/64]&(1<<uint(tip%64)) != 0; fromTip != fromBase {
+				if fromBase {
+					counts[i].Behind++
+				} else {
+					counts[i].Ahead++
+				}
+			}
+		}
+		for _, p := range c.Parents {
+			if done[p.id] {
+				continue
+			}
+			pb := bitmap(p.id)
+			for i := range pb {
+				pb[i] |= b[i]
+			}
+			if err := push(p); err != nil {
+				return nil, err
+			}
+		}
+		delete(bitmaps, c.id)
+	}
+	return counts, nil
+}
@@ -3,27 +3,70 @@ package git
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"syscall"
 )
 
+const maxSymrefDepth = 5
+
+var ErrRefLoop = errors.New("Symbolic ref loop")
+
+var errRefNotFound = errors.New("Ref not found")
+
+// Ref is either a direct ref holding SHA1 or a symbolic ref whose Target
+// names another ref.
 type Ref struct {
 	Name   string
+	Target string
 	SHA1   SHA1
 	Commit *SHA1
 }
 
+func (ref *Ref) IsSymbolic() bool {
+	return ref.Target != ""
+}
+
 type Refs []*Ref
 
-func (refs Refs) merge(other []*Ref) []*Ref {
-	m := refsToMap(refs)
-	for _, ref := range other {
-		m[ref.Name] = ref
-	}
-	return mapToRefs(m)
+// refBackend stores the refs and reflogs of a repository, either as loose
+// files with packed-refs or as a reftable stack.
+type refBackend interface {
+	// rawRef reads a ref without following symbolic refs.
+	rawRef(name string) (*Ref, error)
+	// refs returns every ref under refs/ without following symbolic refs.
+	refs() (map[string]*Ref, error)
+	// refUnder returns the name of a ref below dir, used to detect conflicts
+	// such as refs/heads/a against refs/heads/a/b.
+	refUnder(dir string) string
+	// prepare locks the refs of a transaction, checks their old values and
+	// stages the new values, which commit then makes visible.
+	prepare(tx *RefTransaction) error
+	commit(tx *RefTransaction) error
+	reflog(name string) ([]*ReflogEntry, error)
+	hasReflog(name string) bool
+	reflogNames() ([]string, error)
+	// expireReflog removes the reflog entries of name for which keep
+	// returns false.
+	expireReflog(name string, keep func(*ReflogEntry) bool) error
+	pack(opts PackRefsOptions) error
+}
+
+type filesRefBackend struct {
+	repo   *Repository
+	root   string
+	packed *PackedRefs
+}
+
+func newFilesRefBackend(r *Repository) *filesRefBackend {
+	return &filesRefBackend{repo: r, root: r.root, packed: OpenPackedRefs(r.root)}
 }
 
 func (refs Refs) find(suffix string) *Ref {
@@ -35,89 +78,229 @@ func (refs Refs) find(suffix string) *Ref {
 	return nil
 }
 
+// Ref returns the direct ref which name finally points to after following
+// symbolic refs.
 func (r *Repository) Ref(name string) (*Ref, error) {
-	if ref, err := r.looseRef(name); err == nil {
+	ref, err := r.RawRef(name)
+	if err != nil {
+		return nil, err
+	}
+	return r.resolveRef(ref)
+}
+
+// RawRef returns the ref without following it even if it is symbolic.
+func (r *Repository) RawRef(name string) (*Ref, error) {
+	if err := checkRefName(name); err != nil {
+		return nil, err
+	}
+	ref, err := r.refs.rawRef(name)
+	if err == errRefNotFound {
+		return nil, fmt.Errorf("Ref not found: %s", name)
+	}
+	return ref, err
+}
+
+func (r *Repository) resolveRef(ref *Ref) (*Ref, error) {
+	seen := map[string]bool{ref.Name: true}
+	for ref.IsSymbolic() {
+		if seen[ref.Target] {
+			return nil, ErrRefLoop
+		}
+		if len(seen) > maxSymrefDepth {
+			return nil, fmt.Errorf("Symbolic ref too deep: %s", ref.Target)
+		}
+		seen[ref.Target] = true
+		next, err := r.RawRef(ref.Target)
+		if err != nil {
+			return nil, err
+		}
+		ref = next
+	}
+	return ref, nil
+}
+
+func (b *filesRefBackend) rawRef(name string) (*Ref, error) {
+	ref, err := b.looseRef(name)
+	if err == nil {
 		return ref, nil
+	} else if !looseRefMissing(err) {
+		return nil, err
 	}
-	if ref := r.packedRefs.Ref(name); ref != nil {
+	if ref := b.packed.Ref(name); ref != nil {
 		return ref, nil
+	} else if err := b.packed.Err; err != nil && !os.IsNotExist(err) {
+		return nil, err
 	}
-	return nil, fmt.Errorf("Ref not found: %s", name)
+	return nil, errRefNotFound
 }
 
-func (r *Repository) looseRef(name string) (*Ref, error) {
-	f, err := os.Open(filepath.Join(r.root, name))
+// looseRefMissing reports whether reading a loose ref failed because there
+// is no file for it, including when a directory is in the way or a file
+// takes the place of one of its directories.
+func looseRefMissing(err error) bool {
+	if os.IsNotExist(err) {
+		return true
+	}
+	pe, ok := err.(*os.PathError)
+	return ok && (pe.Err == syscall.EISDIR || pe.Err == syscall.ENOTDIR)
+}
+
+// refs merges loose refs over packed ones.
+func (b *filesRefBackend) refs() (map[string]*Ref, error) {
+	m := refsToMap(b.packed.Refs("refs/"))
+	loose, err := b.looseRefs()
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	for name, ref := range loose {
+		m[name] = ref
+	}
+	return m, nil
+}
+
+func (b *filesRefBackend) refUnder(dir string) string {
+	if refs := b.packed.Refs(dir + "/"); len(refs) > 0 {
+		return refs[0].Name
+	}
+	// a directory left without refs is removed like git does
+	path := filepath.Join(b.root, dir)
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() && os.Remove(path) != nil {
+		return dir + "/"
+	}
+	return ""
+}
 
-	buf := bufio.NewReader(f)
-	b, err := buf.ReadBytes('\n')
+func (b *filesRefBackend) looseRef(name string) (*Ref, error) {
+	data, err := ioutil.ReadFile(filepath.Join(b.root, name))
 	if err != nil {
 		return nil, err
 	}
-	return &Ref{Name: name, SHA1: SHA1FromString(string(b[:len(b)-1]))}, nil
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("ref: ")) {
+		return &Ref{Name: name, Target: string(bytes.TrimSpace(data[5:]))}, nil
+	}
+	id, err := NewSHA1(string(data))
+	if err != nil {
+		return nil, err
+	}
+	return &Ref{Name: name, SHA1: id}, nil
 }
 
 func (r *Repository) Branches() []*Ref {
-	prefix := filepath.Join("refs", "heads")
-	refs := r.packedRefs.Refs(prefix)
-	loose, err := r.looseRefs(prefix)
+	refs, err := r.matchingRefs("refs/heads/")
 	if err != nil {
 		return nil
 	}
-	return Refs(refs).merge(loose)
+	return refs
 }
 
-func (r Repository) Tags() []*Ref {
-	prefix := filepath.Join("refs", "tags")
-	refs := r.packedRefs.Refs(prefix)
-	loose, err := r.looseRefs(prefix)
+func (r *Repository) Tags() []*Ref {
+	refs, err := r.matchingRefs("refs/tags/")
 	if err != nil {
 		return nil
 	}
-	return Refs(refs).merge(loose)
+	return refs
 }
 
-func (r Repository) looseRefs(path string) ([]*Ref, error) {
-	path = filepath.Join(r.root, path)
-	files, err := ioutil.ReadDir(path)
+// ForEachRef calls fn for every ref under refs/ matching pattern, in sorted
+// order. A pattern matches a ref either as a glob or literally from the
+// beginning up to a slash, like git for-each-ref. An empty pattern matches
+// every ref.
+func (r *Repository) ForEachRef(pattern string, fn func(*Ref) error) error {
+	refs, err := r.matchingRefs(pattern)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	var refs []*Ref
-	for _, file := range files {
-		name := filepath.Join(path, file.Name())
-		if ref, err := r.Ref(name); err == nil {
-			refs = append(refs, ref)
+	for _, ref := range refs {
+		if err = fn(ref); err != nil {
+			return err
 		}
 	}
-	return refs, nil
+	return nil
 }
 
-func (r *Repository) Head() (*Ref, error) {
-	f, err := os.Open(filepath.Join(r.root, "HEAD"))
+func (r *Repository) matchingRefs(pattern string) ([]*Ref, error) {
+	m, err := r.refs.refs()
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 
-	buf := bufio.NewReader(f)
-	b, err := buf.ReadBytes('\n')
-	if err != nil {
-		return nil, err
+	var refs []*Ref
+	for name, ref := range m {
+		if !matchRefPattern(pattern, name) || checkRefName(name) != nil {
+			continue
+		}
+		if ref.IsSymbolic() {
+			target, err := r.resolveRef(ref)
+			if err != nil { // dangling symref
+				continue
+			}
+			ref.SHA1 = target.SHA1
+		}
+		refs = append(refs, ref)
 	}
-	if !bytes.HasPrefix(b, []byte("ref: ")) {
-		return nil, ErrUnknownFormat
+	sort.Sort(refsByName(refs))
+	return refs, nil
+}
+
+// looseRefs reads every loose ref under refs/ without following symbolic
+// refs.
+func (b *filesRefBackend) looseRefs() (map[string]*Ref, error) {
+	m := make(map[string]*Ref)
+	err := filepath.Walk(filepath.Join(b.root, "refs"), func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+		rel, err := filepath.Rel(b.root, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if checkRefName(name) != nil { // git ignores refs with broken names
+			return nil
+		}
+		if ref, err := b.looseRef(name); err == nil {
+			m[name] = ref
+		}
+		return nil
+	})
+	return m, err
+}
+
+func matchRefPattern(pattern, name string) bool {
+	if pattern == "" {
+		return true
+	}
+	if strings.ContainsAny(pattern, "*?[") {
+		ok, _ := path.Match(pattern, name)
+		return ok
 	}
-	return r.Ref(string(b[5 : len(b)-1]))
+	if !strings.HasPrefix(name, pattern) {
+		return false
+	}
+	return len(name) == len(pattern) || strings.HasSuffix(pattern, "/") || name[len(pattern)] == '/'
+}
+
+// Head returns the branch HEAD points to, or HEAD itself if detached.
+func (r *Repository) Head() (*Ref, error) {
+	return r.Ref("HEAD")
 }
 
+const packedRefsHeader = "# pack-refs with:"
+
+// PackedRefs holds the refs in packed-refs. Traits are the capabilities
+// listed in its header such as "peeled", "fully-peeled" and "sorted".
 type PackedRefs struct {
-	Path string
-	Err  error
-	refs map[string]*Ref
+	Path   string
+	Err    error
+	Traits []string
+	refs   map[string]*Ref
 }
 
 func OpenPackedRefs(root string) *PackedRefs {
@@ -150,6 +333,7 @@ func (p *PackedRefs) Refs(prefix string) []*Ref {
 
 func (p *PackedRefs) Parse() error {
 	p.refs = make(map[string]*Ref)
+	p.Traits = nil
 	f, err := os.Open(p.Path)
 	if err != nil {
 		return err
@@ -160,10 +344,14 @@ func (p *PackedRefs) Parse() error {
 	scan := bufio.NewScanner(f)
 	for scan.Scan() {
 		line := scan.Bytes()
+		if bytes.HasPrefix(line, []byte(packedRefsHeader)) {
+			p.Traits = strings.Fields(string(line[len(packedRefsHeader):]))
+			continue
+		}
 		if pos := bytes.IndexByte(line, '#'); pos != -1 {
 			line = line[:pos]
 		}
-		bytes.TrimSpace(line)
+		line = bytes.TrimSpace(line)
 		if len(line) == 0 {
 			continue
 		}
@@ -171,7 +359,10 @@ func (p *PackedRefs) Parse() error {
 			if ref == nil {
 				return ErrUnknownFormat
 			}
-			commit := SHA1FromString(string(line[1:]))
+			commit, err := NewSHA1(string(line[1:]))
+			if err != nil {
+				return ErrUnknownFormat
+			}
 			ref.Commit = &commit
 			continue
 		}
@@ -179,8 +370,12 @@ func (p *PackedRefs) Parse() error {
 		if len(items) != 2 {
 			return ErrUnknownFormat
 		}
+		id, err := NewSHA1(string(items[0]))
+		if err != nil {
+			return ErrUnknownFormat
+		}
 		name := string(items[1])
-		ref = &Ref{Name: name, SHA1: SHA1FromString(string(items[0]))}
+		ref = &Ref{Name: name, SHA1: id}
 		p.refs[name] = ref
 	}
 	if err := scan.Err(); err != nil {
@@ -189,6 +384,39 @@ func (p *PackedRefs) Parse() error {
 	return nil
 }
 
+func (p *PackedRefs) HasTrait(trait string) bool {
+	for _, t := range p.Traits {
+		if t == trait {
+			return true
+		}
+	}
+	return false
+}
+
+// Write writes the refs sorted by name in the packed-refs format, followed by
+// a peeled line for refs which have Commit set. The header lists Traits
+// and "sorted".
+func (p *PackedRefs) Write(w io.Writer) error {
+	traits := p.Traits
+	if !p.HasTrait("sorted") {
+		traits = append(traits[:len(traits):len(traits)], "sorted")
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s %s \n", packedRefsHeader, strings.Join(traits, " "))
+	refs := make([]*Ref, 0, len(p.refs))
+	for _, ref := range p.refs {
+		refs = append(refs, ref)
+	}
+	sort.Sort(refsByName(refs))
+	for _, ref := range refs {
+		fmt.Fprintf(bw, "%s %s\n", ref.SHA1, ref.Name)
+		if ref.Commit != nil {
+			fmt.Fprintf(bw, "^%s\n", ref.Commit)
+		}
+	}
+	return bw.Flush()
+}
+
 func refsToMap(refs []*Ref) map[string]*Ref {
 	out := make(map[string]*Ref)
 	for _, ref := range refs {
@@ -197,9 +425,8 @@ func refsToMap(refs []*Ref) map[string]*Ref {
 	return out
 }
 
-func mapToRefs(m map[string]*Ref) (refs []*Ref) {
-	for _, ref := range m {
-		refs = append(refs, ref)
-	}
-	return
-}
+type refsByName []*Ref
+
+func (s refsByName) Len() int           { return len(s) }
+func (s refsByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s refsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,309 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultReflogExpire            = 90 * 24 * time.Hour
+	DefaultReflogExpireUnreachable = 30 * 24 * time.Hour
+)
+
+type ReflogEntry struct {
+	Old       SHA1
+	New       SHA1
+	Committer *User
+	Message   string
+}
+
+type ReflogExpireOptions struct {
+	// Expire removes entries older than it. Zero means DefaultReflogExpire
+	// and a negative value removes them all.
+	Expire time.Duration
+	// ExpireUnreachable removes entries older than it which new value is not
+	// reachable from the tip of the ref. Zero means
+	// DefaultReflogExpireUnreachable.
+	ExpireUnreachable time.Duration
+}
+
+func (e *ReflogEntry) line() []byte {
+	return []byte(fmt.Sprintf("%s %s %s\t%s\n", e.Old, e.New, e.Committer, e.Message))
+}
+
+// Reflog returns the reflog entries of the ref name, oldest first. A ref
+// without a reflog has no entries.
+func (r *Repository) Reflog(name string) ([]*ReflogEntry, error) {
+	if err := checkRefName(name); err != nil {
+		return nil, err
+	}
+	return r.refs.reflog(name)
+}
+
+func (b *filesRefBackend) reflog(name string) ([]*ReflogEntry, error) {
+	data, err := ioutil.ReadFile(filepath.Join(b.root, "logs", name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return parseReflog(data), nil
+}
+
+// parseReflog skips malformed lines as git does.
+func parseReflog(data []byte) []*ReflogEntry {
+	var entries []*ReflogEntry
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if e, err := parseReflogEntry(line); err == nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+func parseReflogEntry(line []byte) (*ReflogEntry, error) {
+	var (
+		e   ReflogEntry
+		err error
+	)
+	if pos := bytes.IndexByte(line, '\t'); pos != -1 {
+		e.Message = string(line[pos+1:])
+		line = line[:pos]
+	}
+	fields := bytes.SplitN(line, []byte{' '}, 3)
+	if len(fields) != 3 {
+		return nil, ErrUnknownFormat
+	}
+	if e.Old, err = NewSHA1(string(fields[0])); err != nil {
+		return nil, err
+	}
+	if e.New, err = NewSHA1(string(fields[1])); err != nil {
+		return nil, err
+	}
+	if e.Committer, err = newUser(fields[2]); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (b *filesRefBackend) hasReflog(name string) bool {
+	_, err := os.Stat(filepath.Join(b.root, "logs", name))
+	return err == nil
+}
+
+func (b *filesRefBackend) appendReflog(name string, e *ReflogEntry) error {
+	path := filepath.Join(b.root, "logs", name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(e.line()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (b *filesRefBackend) deleteReflog(name string) error {
+	path := filepath.Join(b.root, "logs", name)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	removeEmptyDirs(filepath.Join(b.root, "logs"), filepath.Dir(path))
+	return nil
+}
+
+// shouldLogRef follows core.logAllRefUpdates. Refs which already have a
+// reflog are always logged.
+func (r *Repository) shouldLogRef(name string) bool {
+	if r.refs.hasReflog(name) {
+		return true
+	}
+	if strings.ToLower(r.config.Get("core.logallrefupdates")) == "always" {
+		return true
+	}
+	if !r.config.Bool("core.logallrefupdates", !r.Bare) {
+		return false
+	}
+	for _, prefix := range []string{"refs/heads/", "refs/remotes/", "refs/notes/"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return name == "HEAD"
+}
+
+// defaultIdent returns the committer identity taken from the environment or
+// user.name and user.email, falling back to the login name and host name.
+func (r *Repository) defaultIdent() *User {
+	name := os.Getenv("GIT_COMMITTER_NAME")
+	if name == "" {
+		name = r.config.Get("user.name")
+	}
+	email := os.Getenv("GIT_COMMITTER_EMAIL")
+	if email == "" {
+		email = r.config.Get("user.email")
+	}
+	if email == "" {
+		email = os.Getenv("EMAIL")
+	}
+	if name == "" || email == "" {
+		login := "unknown"
+		if u, err := user.Current(); err == nil {
+			login = u.Username
+		}
+		if name == "" {
+			name = login
+		}
+		if email == "" {
+			host, _ := os.Hostname()
+			email = login + "@" + host
+		}
+	}
+	return &User{Name: name, Email: email, Date: time.Now()}
+}
+
+// ExpireReflog removes old entries from the reflog of name like
+// git reflog expire.
+func (r *Repository) ExpireReflog(name string, opts ReflogExpireOptions) error {
+	if err := checkRefName(name); err != nil {
+		return err
+	}
+	expire, expireUnreachable := opts.Expire, opts.ExpireUnreachable
+	if expire == 0 {
+		expire = DefaultReflogExpire
+	}
+	if expireUnreachable == 0 {
+		expireUnreachable = DefaultReflogExpireUnreachable
+	}
+	now := time.Now()
+	cutoff, unreachableCutoff := now.Add(-expire), now.Add(-expireUnreachable)
+
+	var reachable map[SHA1]bool
+	return r.refs.expireReflog(name, func(e *ReflogEntry) bool {
+		date := e.Committer.Date
+		if date.Before(cutoff) {
+			return false
+		}
+		if date.Before(unreachableCutoff) {
+			if reachable == nil {
+				reachable = r.reflogReachable(name)
+			}
+			return reachable[e.New]
+		}
+		return true
+	})
+}
+
+func (b *filesRefBackend) expireReflog(name string, keep func(*ReflogEntry) bool) error {
+	// hold the ref lock so that no entry is appended meanwhile
+	ref, err := lockPath(filepath.Join(b.root, name))
+	if err != nil {
+		return err
+	}
+	defer ref.Rollback()
+	entries, err := b.reflog(name)
+	if err != nil || entries == nil {
+		return err
+	}
+	var kept []*ReflogEntry
+	for _, e := range entries {
+		if keep(e) {
+			kept = append(kept, e)
+		}
+	}
+	if len(kept) == len(entries) {
+		return nil
+	}
+
+	lock, err := lockPath(filepath.Join(b.root, "logs", name))
+	if err != nil {
+		return err
+	}
+	for _, e := range kept {
+		if _, err = lock.Write(e.line()); err != nil {
+			lock.Rollback()
+			return err
+		}
+	}
+	return lock.Commit()
+}
+
+// ExpireReflogs expires every reflog in the repository.
+func (r *Repository) ExpireReflogs(opts ReflogExpireOptions) error {
+	names, err := r.refs.reflogNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err = r.ExpireReflog(name, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *filesRefBackend) reflogNames() ([]string, error) {
+	var names []string
+	dir := filepath.Join(b.root, "logs")
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); checkRefName(name) == nil {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+// reflogReachable returns the commits reachable from the current value of
+// the ref name. Missing objects are ignored.
+func (r *Repository) reflogReachable(name string) map[SHA1]bool {
+	reachable := make(map[SHA1]bool)
+	ref, err := r.Ref(name)
+	if err != nil {
+		return reachable
+	}
+	stack := []SHA1{ref.SHA1}
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if reachable[id] {
+			continue
+		}
+		reachable[id] = true
+		typ, data, err := r.readRaw(id)
+		if err != nil || (typ != "commit" && typ != "tag") {
+			continue
+		}
+		for _, h := range objectHeaders(data) {
+			if h.key == "parent" || h.key == "object" {
+				if parent, err := NewSHA1(h.value); err == nil {
+					stack = append(stack, parent)
+				}
+			}
+		}
+	}
+	return reachable
+}
@@ -0,0 +1,107 @@
+package git
+
+import (
+	"fmt"
+	"strings"
+)
+
+type RefFormatOptions struct {
+	// AllowOneLevel accepts names without a slash such as "HEAD".
+	AllowOneLevel bool
+	// RefspecPattern accepts a single '*' as used in refspecs.
+	RefspecPattern bool
+}
+
+type InvalidRefNameError struct {
+	Name   string
+	Reason string
+}
+
+func (e *InvalidRefNameError) Error() string {
+	return fmt.Sprintf("Invalid ref name %q: %s", e.Name, e.Reason)
+}
+
+// CheckRefFormat validates name with the rules of git check-ref-format.
+func CheckRefFormat(name string, opts RefFormatOptions) error {
+	invalid := func(format string, args ...interface{}) error {
+		return &InvalidRefNameError{Name: name, Reason: fmt.Sprintf(format, args...)}
+	}
+	if name == "@" {
+		return invalid("'@' alone is not allowed")
+	}
+	components := strings.Split(name, "/")
+	stars := 0
+	for _, c := range components {
+		if c == "" {
+			return invalid("empty component")
+		}
+		if c[0] == '.' {
+			return invalid("component begins with '.'")
+		}
+		if strings.HasSuffix(c, ".lock") {
+			return invalid("component ends with '.lock'")
+		}
+		for i := 0; i < len(c); i++ {
+			ch := c[i]
+			switch {
+			case ch < 040 || ch == 0177:
+				return invalid("contains a control character")
+			case strings.IndexByte(" ~^:?[\\", ch) != -1:
+				return invalid("contains %q", ch)
+			case ch == '*':
+				if !opts.RefspecPattern || stars > 0 {
+					return invalid("contains %q", ch)
+				}
+				stars++
+			case ch == '.' && i+1 < len(c) && c[i+1] == '.':
+				return invalid("contains '..'")
+			case ch == '@' && i+1 < len(c) && c[i+1] == '{':
+				return invalid("contains '@{'")
+			}
+		}
+	}
+	if strings.HasSuffix(name, ".") {
+		return invalid("ends with '.'")
+	}
+	if len(components) < 2 && !opts.AllowOneLevel {
+		return invalid("must contain at least one '/'")
+	}
+	return nil
+}
+
+// checkRefName validates a name before it is used as a path under the
+// repository. Only names under refs/ and root refs such as HEAD or
+// FETCH_HEAD are accepted.
+func checkRefName(name string) error {
+	if err := CheckRefFormat(name, RefFormatOptions{AllowOneLevel: true}); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(name, "refs/") && !isRootRef(name) {
+		return &InvalidRefNameError{Name: name, Reason: "neither under refs/ nor a root ref"}
+	}
+	return nil
+}
+
+// irregularRootRefs are the root refs of git not ending with _HEAD.
+var irregularRootRefs = map[string]bool{
+	"AUTO_MERGE":          true,
+	"BISECT_EXPECTED_REV": true,
+	"NOTES_MERGE_PARTIAL": true,
+	"NOTES_MERGE_REF":     true,
+	"MERGE_AUTOSTASH":     true,
+}
+
+// isRootRef reports whether name is HEAD, ends with _HEAD or is one of
+// irregularRootRefs. Other upper case names such as CONFIG or INDEX would
+// clash with files of the repository on case-insensitive filesystems.
+func isRootRef(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'A' || c > 'Z') && c != '_' {
+			return false
+		}
+	}
+	return name == "HEAD" || strings.HasSuffix(name, "_HEAD") || irregularRootRefs[name]
+}
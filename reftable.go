@@ -0,0 +1,597 @@
+package git
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+var reftableMagic = [4]byte{'R', 'E', 'F', 'T'}
+
+const (
+	reftableBlockRef   = 'r'
+	reftableBlockIndex = 'i'
+	reftableBlockObj   = 'o'
+	reftableBlockLog   = 'g'
+
+	reftableHashSHA1   = 0x73686131 // "sha1"
+	reftableHashSHA256 = 0x73323536 // "s256"
+
+	DefaultReftableBlockSize = 4096
+	reftableRestartInterval  = 16
+)
+
+type ReftableHeader struct {
+	Magic          [4]byte
+	Version        uint8
+	BlockSize      uint32
+	MinUpdateIndex uint64
+	MaxUpdateIndex uint64
+	Format         ObjectFormat
+}
+
+func (h *ReftableHeader) size() int {
+	if h.Version == 2 {
+		return 28
+	}
+	return 24
+}
+
+func (h *ReftableHeader) footerSize() int {
+	return h.size() + 5*8 + 4
+}
+
+func (h *ReftableHeader) parse(data []byte) error {
+	if len(data) < 24 {
+		return ErrUnknownFormat
+	}
+	copy(h.Magic[:], data)
+	h.Version = data[4]
+	if h.Magic != reftableMagic || (h.Version != 1 && h.Version != 2) || len(data) < h.size() {
+		return ErrUnknownFormat
+	}
+	h.BlockSize = uint32(getUint24(data[5:]))
+	h.MinUpdateIndex = binary.BigEndian.Uint64(data[8:])
+	h.MaxUpdateIndex = binary.BigEndian.Uint64(data[16:])
+	h.Format = FormatSHA1
+	if h.Version == 2 {
+		switch binary.BigEndian.Uint32(data[24:]) {
+		case reftableHashSHA1:
+		case reftableHashSHA256:
+			h.Format = FormatSHA256
+		default:
+			return ErrUnknownFormat
+		}
+	}
+	return nil
+}
+
+func (h *ReftableHeader) bytes() []byte {
+	b := make([]byte, h.size())
+	copy(b, reftableMagic[:])
+	b[4] = h.Version
+	putUint24(b[5:], int(h.BlockSize))
+	binary.BigEndian.PutUint64(b[8:], h.MinUpdateIndex)
+	binary.BigEndian.PutUint64(b[16:], h.MaxUpdateIndex)
+	if h.Version == 2 {
+		id := uint32(reftableHashSHA1)
+		if h.Format == FormatSHA256 {
+			id = reftableHashSHA256
+		}
+		binary.BigEndian.PutUint32(b[24:], id)
+	}
+	return b
+}
+
+// Reftable is a single table of a reftable stack, holding ref and log
+// records sorted by key. Deleted records shadow older tables in the stack.
+type Reftable struct {
+	ReftableHeader
+	Path string
+	Refs []*ReftableRef
+	Logs []*ReftableLog
+}
+
+type ReftableRef struct {
+	Ref
+	UpdateIndex uint64
+	Deleted     bool
+}
+
+type ReftableLog struct {
+	ReflogEntry
+	Name        string
+	UpdateIndex uint64
+	Deleted     bool
+}
+
+func (l *ReftableLog) key() []byte {
+	key := make([]byte, len(l.Name)+9)
+	copy(key, l.Name)
+	binary.BigEndian.PutUint64(key[len(l.Name)+1:], ^l.UpdateIndex)
+	return key
+}
+
+func OpenReftable(path string) (*Reftable, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &Reftable{Path: path}
+	return t, t.Parse(data)
+}
+
+func (t *Reftable) Parse(data []byte) error {
+	if err := t.ReftableHeader.parse(data); err != nil {
+		return err
+	}
+	headerSize, footerSize := t.size(), t.footerSize()
+	if len(data) < headerSize+footerSize {
+		return ErrUnknownFormat
+	}
+	end := len(data) - footerSize
+	footer := data[end:]
+	if !bytes.Equal(footer[:headerSize], data[:headerSize]) ||
+		crc32.ChecksumIEEE(footer[:footerSize-4]) != binary.BigEndian.Uint32(footer[footerSize-4:]) {
+		return ErrUnknownFormat
+	}
+	logPos := int(binary.BigEndian.Uint64(footer[headerSize+24:]))
+
+	t.Refs, t.Logs = nil, nil
+	if end == headerSize {
+		return nil
+	}
+	pos := 0
+	if data[headerSize] != reftableBlockLog {
+		for pos+t.headerOffset(pos) < end && data[pos+t.headerOffset(pos)] == reftableBlockRef {
+			block, size, err := t.readBlock(data[:end], pos)
+			if err != nil {
+				return err
+			}
+			if err = t.parseBlock(block, t.headerOffset(pos)); err != nil {
+				return err
+			}
+			pos += size
+		}
+		if logPos == 0 {
+			return nil
+		}
+		pos = logPos
+	}
+	for pos+t.headerOffset(pos) < end && data[pos+t.headerOffset(pos)] == reftableBlockLog {
+		block, size, err := t.readBlock(data[:end], pos)
+		if err != nil {
+			return err
+		}
+		if err = t.parseBlock(block, t.headerOffset(pos)); err != nil {
+			return err
+		}
+		pos += size
+	}
+	return nil
+}
+
+// headerOffset returns the size of the file header preceding the block at
+// pos, which is part of the first block.
+func (t *Reftable) headerOffset(pos int) int {
+	if pos == 0 {
+		return t.size()
+	}
+	return 0
+}
+
+// readBlock returns the block at pos, inflating log blocks, and the number
+// of bytes it occupies in the file including padding.
+func (t *Reftable) readBlock(data []byte, pos int) ([]byte, int, error) {
+	off := t.headerOffset(pos)
+	if pos+off+4 > len(data) {
+		return nil, 0, ErrUnknownFormat
+	}
+	typ := data[pos+off]
+	blockLen := getUint24(data[pos+off+1:])
+	if blockLen < off+4+2 {
+		return nil, 0, ErrUnknownFormat
+	}
+
+	if typ == reftableBlockLog {
+		br := bytes.NewReader(data[pos+off+4:])
+		zr, err := zlib.NewReader(br)
+		if err != nil {
+			return nil, 0, err
+		}
+		block := make([]byte, blockLen)
+		copy(block, data[pos:pos+off+4])
+		if _, err = io.ReadFull(zr, block[off+4:]); err != nil {
+			return nil, 0, err
+		}
+		if err = zr.Close(); err != nil {
+			return nil, 0, err
+		}
+		return block, len(data[pos:]) - br.Len(), nil
+	}
+
+	if pos+blockLen > len(data) {
+		return nil, 0, ErrUnknownFormat
+	}
+	size := int(t.BlockSize)
+	// a block followed by non-zero bytes was written without padding
+	if size < blockLen || pos+blockLen == len(data) || data[pos+blockLen] != 0 || pos+size > len(data) {
+		size = blockLen
+	}
+	return data[pos : pos+blockLen], size, nil
+}
+
+func (t *Reftable) parseBlock(block []byte, off int) error {
+	typ := block[off]
+	restarts := int(binary.BigEndian.Uint16(block[len(block)-2:]))
+	end := len(block) - 2 - 3*restarts
+	if end < off+4 {
+		return ErrUnknownFormat
+	}
+	var key []byte
+	for pos := off + 4; pos < end; {
+		prefix, n := getReftableVarint(block[pos:end])
+		if n == 0 {
+			return ErrUnknownFormat
+		}
+		pos += n
+		suffix, n := getReftableVarint(block[pos:end])
+		if n == 0 {
+			return ErrUnknownFormat
+		}
+		pos += n
+		valueType := byte(suffix & 7)
+		suffix >>= 3
+		if prefix > uint64(len(key)) || suffix > uint64(end-pos) {
+			return ErrUnknownFormat
+		}
+		key = append(key[:prefix:prefix], block[pos:pos+int(suffix)]...)
+		pos += int(suffix)
+
+		var err error
+		switch typ {
+		case reftableBlockRef:
+			n, err = t.parseRef(string(key), valueType, block[pos:end])
+		case reftableBlockLog:
+			n, err = t.parseLog(key, valueType, block[pos:end])
+		default:
+			return ErrUnknownFormat
+		}
+		if err != nil {
+			return err
+		}
+		pos += n
+	}
+	return nil
+}
+
+func (t *Reftable) parseRef(name string, valueType byte, data []byte) (int, error) {
+	delta, pos := getReftableVarint(data)
+	if pos == 0 {
+		return 0, ErrUnknownFormat
+	}
+	rec := &ReftableRef{Ref: Ref{Name: name}, UpdateIndex: t.MinUpdateIndex + delta}
+	size := t.Format.Size()
+	switch valueType {
+	case 0:
+		rec.Deleted = true
+	case 1, 2:
+		if len(data) < pos+int(valueType)*size {
+			return 0, ErrUnknownFormat
+		}
+		rec.SHA1 = sha1FromBytes(data[pos : pos+size])
+		pos += size
+		if valueType == 2 {
+			peeled := sha1FromBytes(data[pos : pos+size])
+			rec.Commit = &peeled
+			pos += size
+		}
+	case 3:
+		target, err := getReftableString(data, &pos)
+		if err != nil {
+			return 0, err
+		}
+		rec.Target = target
+	default:
+		return 0, ErrUnknownFormat
+	}
+	t.Refs = append(t.Refs, rec)
+	return pos, nil
+}
+
+func (t *Reftable) parseLog(key []byte, valueType byte, data []byte) (int, error) {
+	if len(key) < 9 || key[len(key)-9] != 0 {
+		return 0, ErrUnknownFormat
+	}
+	rec := &ReftableLog{
+		Name:        string(key[:len(key)-9]),
+		UpdateIndex: ^binary.BigEndian.Uint64(key[len(key)-8:]),
+	}
+	if valueType == 0 {
+		rec.Deleted = true
+		t.Logs = append(t.Logs, rec)
+		return 0, nil
+	}
+	if valueType != 1 {
+		return 0, ErrUnknownFormat
+	}
+
+	size := t.Format.Size()
+	if len(data) < 2*size {
+		return 0, ErrUnknownFormat
+	}
+	rec.Old = sha1FromBytes(data[:size])
+	rec.New = sha1FromBytes(data[size : 2*size])
+	pos := 2 * size
+	name, err := getReftableString(data, &pos)
+	if err != nil {
+		return 0, err
+	}
+	email, err := getReftableString(data, &pos)
+	if err != nil {
+		return 0, err
+	}
+	sec, n := getReftableVarint(data[pos:])
+	if n == 0 || len(data) < pos+n+2 {
+		return 0, ErrUnknownFormat
+	}
+	pos += n
+	tz := int16(binary.BigEndian.Uint16(data[pos:]))
+	pos += 2
+	msg, err := getReftableString(data, &pos)
+	if err != nil {
+		return 0, err
+	}
+	rec.Committer = &User{
+		Name:  name,
+		Email: email,
+		Date:  time.Unix(int64(sec), 0).In(time.FixedZone("", int(tz)*60)),
+	}
+	rec.Message = string(bytes.TrimSuffix([]byte(msg), []byte{'\n'}))
+	t.Logs = append(t.Logs, rec)
+	return pos, nil
+}
+
+// Write writes the table with its records sorted by key. Indexes are not
+// written as they are optional for readers.
+func (t *Reftable) Write(w io.Writer) error {
+	t.Magic = reftableMagic
+	t.Version = 1
+	if t.Format != FormatSHA1 {
+		t.Version = 2
+	}
+	if t.BlockSize == 0 {
+		t.BlockSize = DefaultReftableBlockSize
+	}
+	header := t.bytes()
+	out := append([]byte(nil), header...)
+	var err error
+
+	refs := append([]*ReftableRef(nil), t.Refs...)
+	sort.Sort(reftableRefsByName(refs))
+	if len(refs) > 0 {
+		out = out[:0]
+		bw := newReftableBlockWriter(reftableBlockRef, header, int(t.BlockSize))
+		for _, rec := range refs {
+			valueType, value := t.encodeRef(rec)
+			if out, bw, err = t.addRecord(out, bw, []byte(rec.Name), valueType, value); err != nil {
+				return err
+			}
+		}
+		out = append(out, bw.finish()...)
+	}
+
+	logPos := 0
+	logs := append([]*ReftableLog(nil), t.Logs...)
+	sort.Sort(reftableLogsByKey(logs))
+	if len(logs) > 0 {
+		var prefix []byte
+		if len(refs) == 0 {
+			out, prefix = out[:0], header
+		} else {
+			logPos = len(out)
+		}
+		bw := newReftableBlockWriter(reftableBlockLog, prefix, int(t.BlockSize))
+		for _, rec := range logs {
+			valueType, value, err := t.encodeLog(rec)
+			if err != nil {
+				return err
+			}
+			if out, bw, err = t.addRecord(out, bw, rec.key(), valueType, value); err != nil {
+				return err
+			}
+		}
+		out = append(out, bw.finish()...)
+	}
+
+	footer := append([]byte(nil), header...)
+	footer = append(footer, make([]byte, 5*8+4)...)
+	binary.BigEndian.PutUint64(footer[len(header)+24:], uint64(logPos))
+	binary.BigEndian.PutUint32(footer[len(footer)-4:], crc32.ChecksumIEEE(footer[:len(footer)-4]))
+	_, err = w.Write(append(out, footer...))
+	return err
+}
+
+// addRecord adds a record to the current block, starting a new block when
+// it is full.
+func (t *Reftable) addRecord(out []byte, bw *reftableBlockWriter, key []byte, valueType byte, value []byte) ([]byte, *reftableBlockWriter, error) {
+	if bw.add(key, valueType, value) {
+		return out, bw, nil
+	}
+	if bw.count == 0 {
+		return out, bw, fmt.Errorf("Reftable record too large: %s", key)
+	}
+	out = append(out, bw.finish()...)
+	bw = newReftableBlockWriter(bw.typ, nil, int(t.BlockSize))
+	if !bw.add(key, valueType, value) {
+		return out, bw, fmt.Errorf("Reftable record too large: %s", key)
+	}
+	return out, bw, nil
+}
+
+func (t *Reftable) encodeRef(rec *ReftableRef) (byte, []byte) {
+	value := encodeDeltaOffset(int64(rec.UpdateIndex - t.MinUpdateIndex))
+	switch {
+	case rec.Deleted:
+		return 0, value
+	case rec.IsSymbolic():
+		return 3, appendReftableString(value, rec.Target)
+	case rec.Commit != nil:
+		return 2, append(append(value, rec.SHA1.Bytes()...), rec.Commit.Bytes()...)
+	}
+	return 1, append(value, rec.SHA1.Bytes()...)
+}
+
+func (t *Reftable) encodeLog(rec *ReftableLog) (byte, []byte, error) {
+	if rec.Deleted {
+		return 0, nil, nil
+	}
+	if rec.Committer == nil {
+		return 0, nil, ErrUnknownFormat
+	}
+	value := append(append([]byte(nil), rec.Old.Bytes()...), rec.New.Bytes()...)
+	value = appendReftableString(value, rec.Committer.Name)
+	value = appendReftableString(value, rec.Committer.Email)
+	value = append(value, encodeDeltaOffset(rec.Committer.Date.Unix())...)
+	_, offset := rec.Committer.Date.Zone()
+	var tz [2]byte
+	binary.BigEndian.PutUint16(tz[:], uint16(int16(offset/60)))
+	value = append(value, tz[:]...)
+	msg := rec.Message
+	if msg != "" {
+		msg += "\n"
+	}
+	return 1, appendReftableString(value, msg), nil
+}
+
+type reftableBlockWriter struct {
+	typ       byte
+	off       int
+	blockSize int
+	data      []byte
+	restarts  []int
+	lastKey   []byte
+	count     int
+}
+
+// newReftableBlockWriter starts a block. The first block of a file is
+// prefixed by the file header.
+func newReftableBlockWriter(typ byte, prefix []byte, blockSize int) *reftableBlockWriter {
+	bw := &reftableBlockWriter{typ: typ, off: len(prefix), blockSize: blockSize}
+	bw.data = append(append(bw.data, prefix...), typ, 0, 0, 0)
+	return bw
+}
+
+func (bw *reftableBlockWriter) add(key []byte, valueType byte, value []byte) bool {
+	restart := bw.count%reftableRestartInterval == 0
+	prefix := 0
+	if !restart {
+		for prefix < len(key) && prefix < len(bw.lastKey) && key[prefix] == bw.lastKey[prefix] {
+			prefix++
+		}
+	}
+	rec := encodeDeltaOffset(int64(prefix))
+	rec = append(rec, encodeDeltaOffset(int64(len(key)-prefix)<<3|int64(valueType))...)
+	rec = append(rec, key[prefix:]...)
+	rec = append(rec, value...)
+
+	restarts := len(bw.restarts)
+	if restart {
+		restarts++
+	}
+	if len(bw.data)+len(rec)+3*restarts+2 > bw.blockSize {
+		return false
+	}
+	if restart {
+		bw.restarts = append(bw.restarts, len(bw.data))
+	}
+	bw.data = append(bw.data, rec...)
+	bw.lastKey = append(bw.lastKey[:0], key...)
+	bw.count++
+	return true
+}
+
+// finish returns the block as written in the file. Log blocks are
+// compressed while other blocks are padded to the block size.
+func (bw *reftableBlockWriter) finish() []byte {
+	var buf [3]byte
+	for _, off := range bw.restarts {
+		putUint24(buf[:], off)
+		bw.data = append(bw.data, buf[:]...)
+	}
+	bw.data = append(bw.data, byte(len(bw.restarts)>>8), byte(len(bw.restarts)))
+	putUint24(bw.data[bw.off+1:], len(bw.data))
+
+	if bw.typ == reftableBlockLog {
+		var out bytes.Buffer
+		out.Write(bw.data[:bw.off+4])
+		zw := zlib.NewWriter(&out)
+		zw.Write(bw.data[bw.off+4:])
+		zw.Close()
+		return out.Bytes()
+	}
+	if len(bw.data) < bw.blockSize {
+		bw.data = append(bw.data, make([]byte, bw.blockSize-len(bw.data))...)
+	}
+	return bw.data
+}
+
+// getReftableVarint decodes the varint used by reftable, which is the same
+// encoding as OFS_DELTA offsets. It returns 0 bytes read on error.
+func getReftableVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	c := b[0]
+	val := uint64(c & 0x7f)
+	n := 1
+	for c&0x80 != 0 {
+		if n >= len(b) || n > 9 {
+			return 0, 0
+		}
+		c = b[n]
+		n++
+		val = (val+1)<<7 | uint64(c&0x7f)
+	}
+	return val, n
+}
+
+func getReftableString(data []byte, pos *int) (string, error) {
+	size, n := getReftableVarint(data[*pos:])
+	if n == 0 || size > uint64(len(data)-*pos-n) {
+		return "", ErrUnknownFormat
+	}
+	start := *pos + n
+	*pos = start + int(size)
+	return string(data[start:*pos]), nil
+}
+
+func appendReftableString(b []byte, s string) []byte {
+	return append(append(b, encodeDeltaOffset(int64(len(s)))...), s...)
+}
+
+func getUint24(b []byte) int {
+	return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+}
+
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v>>16), byte(v>>8), byte(v)
+}
+
+type reftableRefsByName []*ReftableRef
+
+func (s reftableRefsByName) Len() int           { return len(s) }
+func (s reftableRefsByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+func (s reftableRefsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type reftableLogsByKey []*ReftableLog
+
+func (s reftableLogsByKey) Len() int           { return len(s) }
+func (s reftableLogsByKey) Less(i, j int) bool { return bytes.Compare(s[i].key(), s[j].key()) < 0 }
+func (s reftableLogsByKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,398 @@
+package git
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ReftableStack is the list of tables in reftable/tables.list, oldest
+// first. Records of newer tables take precedence over older ones.
+type ReftableStack struct {
+	Path   string
+	Tables []*Reftable
+	list   []byte
+	refs   map[string]*ReftableRef
+	logs   map[string][]*ReftableLog
+}
+
+// OpenReftableStack reads the stack in dir. Tables removed by a concurrent
+// compaction cause the list to be read again.
+func OpenReftableStack(dir string) (*ReftableStack, error) {
+	for retry := 0; ; retry++ {
+		s := &ReftableStack{Path: dir}
+		err := s.load()
+		if err == nil {
+			return s, nil
+		}
+		if !os.IsNotExist(err) || s.list == nil || retry >= 4 {
+			return nil, err
+		}
+	}
+}
+
+func (s *ReftableStack) load() error {
+	list, err := ioutil.ReadFile(filepath.Join(s.Path, "tables.list"))
+	if err != nil {
+		return err
+	}
+	s.list = list
+	for _, name := range strings.Fields(string(list)) {
+		t, err := OpenReftable(filepath.Join(s.Path, name))
+		if err != nil {
+			return err
+		}
+		s.Tables = append(s.Tables, t)
+	}
+	s.merge()
+	return nil
+}
+
+func (s *ReftableStack) merge() {
+	s.refs = make(map[string]*ReftableRef)
+	s.logs = make(map[string][]*ReftableLog)
+	seen := make(map[string]bool)
+	for i := len(s.Tables) - 1; i >= 0; i-- {
+		t := s.Tables[i]
+		for _, rec := range t.Refs {
+			if _, ok := s.refs[rec.Name]; !ok {
+				s.refs[rec.Name] = rec
+			}
+		}
+		for _, rec := range t.Logs {
+			key := string(rec.key())
+			if !seen[key] {
+				seen[key] = true
+				s.logs[rec.Name] = append(s.logs[rec.Name], rec)
+			}
+		}
+	}
+	for name, rec := range s.refs {
+		if rec.Deleted {
+			delete(s.refs, name)
+		}
+	}
+	for name, logs := range s.logs {
+		var live []*ReftableLog
+		for _, rec := range logs {
+			if !rec.Deleted {
+				live = append(live, rec)
+			}
+		}
+		if len(live) == 0 {
+			delete(s.logs, name)
+			continue
+		}
+		sort.Sort(reftableLogsByUpdateIndex(live))
+		s.logs[name] = live
+	}
+}
+
+// Ref returns a copy of the ref name, or nil if it does not exist.
+func (s *ReftableStack) Ref(name string) *Ref {
+	rec := s.refs[name]
+	if rec == nil {
+		return nil
+	}
+	ref := rec.Ref
+	return &ref
+}
+
+// Refs returns copies of the refs whose names start with prefix.
+func (s *ReftableStack) Refs(prefix string) []*Ref {
+	var refs []*Ref
+	for name, rec := range s.refs {
+		if strings.HasPrefix(name, prefix) {
+			ref := rec.Ref
+			refs = append(refs, &ref)
+		}
+	}
+	sort.Sort(refsByName(refs))
+	return refs
+}
+
+// Logs returns the reflog entries of the ref name, oldest first.
+func (s *ReftableStack) Logs(name string) []*ReftableLog {
+	return s.logs[name]
+}
+
+func (s *ReftableStack) NextUpdateIndex() uint64 {
+	if len(s.Tables) == 0 {
+		return 1
+	}
+	return s.Tables[len(s.Tables)-1].MaxUpdateIndex + 1
+}
+
+func (s *ReftableStack) names() []string {
+	var names []string
+	for _, t := range s.Tables {
+		names = append(names, filepath.Base(t.Path))
+	}
+	return names
+}
+
+func reftableName(min, max uint64) string {
+	var suffix [4]byte
+	rand.Read(suffix[:])
+	return fmt.Sprintf("0x%012x-0x%012x-%x.ref", min, max, suffix)
+}
+
+type reftableRefBackend struct {
+	repo  *Repository
+	dir   string
+	stack *ReftableStack
+}
+
+func newReftableRefBackend(r *Repository) *reftableRefBackend {
+	return &reftableRefBackend{repo: r, dir: filepath.Join(r.root, "reftable")}
+}
+
+// current returns the stack, reloading it when tables.list has changed.
+func (b *reftableRefBackend) current() (*ReftableStack, error) {
+	if b.stack != nil {
+		list, err := ioutil.ReadFile(filepath.Join(b.dir, "tables.list"))
+		if err == nil && bytes.Equal(list, b.stack.list) {
+			return b.stack, nil
+		}
+	}
+	stack, err := OpenReftableStack(b.dir)
+	if err != nil {
+		return nil, err
+	}
+	b.stack = stack
+	return stack, nil
+}
+
+func (b *reftableRefBackend) rawRef(name string) (*Ref, error) {
+	stack, err := b.current()
+	if err != nil {
+		return nil, err
+	}
+	if ref := stack.Ref(name); ref != nil {
+		return ref, nil
+	}
+	return nil, errRefNotFound
+}
+
+func (b *reftableRefBackend) refs() (map[string]*Ref, error) {
+	stack, err := b.current()
+	if err != nil {
+		return nil, err
+	}
+	return refsToMap(stack.Refs("refs/")), nil
+}
+
+func (b *reftableRefBackend) refUnder(dir string) string {
+	stack, err := b.current()
+	if err != nil {
+		return ""
+	}
+	if refs := stack.Refs(dir + "/"); len(refs) > 0 {
+		return refs[0].Name
+	}
+	return ""
+}
+
+// lockStack locks tables.list and reloads the stack so that it reflects
+// every table committed before.
+func (b *reftableRefBackend) lockStack(tx *RefTransaction) (*lockFile, *ReftableStack, error) {
+	lock, err := tx.lock(filepath.Join(b.dir, "tables.list"))
+	if err != nil {
+		return nil, nil, err
+	}
+	b.stack = nil
+	stack, err := b.current()
+	return lock, stack, err
+}
+
+// addTable stages a new table on top of the stack. The table is written
+// under a lock file and tables.list is rewritten into the held list lock,
+// so that both become visible on commit.
+func (b *reftableRefBackend) addTable(tx *RefTransaction, list *lockFile, stack *ReftableStack, t *Reftable) error {
+	name := reftableName(t.MinUpdateIndex, t.MaxUpdateIndex)
+	lock, err := tx.lock(filepath.Join(b.dir, name))
+	if err != nil {
+		return err
+	}
+	if err = t.Write(lock); err != nil {
+		return err
+	}
+	names := append(stack.names(), name)
+	_, err = list.Write([]byte(strings.Join(names, "\n") + "\n"))
+	return err
+}
+
+func (b *reftableRefBackend) prepare(tx *RefTransaction) error {
+	r := tx.repo
+	list, stack, err := b.lockStack(tx)
+	if err != nil {
+		return err
+	}
+	index := stack.NextUpdateIndex()
+	t := &Reftable{}
+	t.Format, t.MinUpdateIndex, t.MaxUpdateIndex = r.Format, index, index
+
+	for _, u := range tx.updates {
+		if u.current, err = r.checkOldValue(u.name, u.old); err != nil {
+			return err
+		}
+		switch {
+		case u.verify:
+		case u.deletion():
+			t.Refs = append(t.Refs, &ReftableRef{Ref: Ref{Name: u.name}, UpdateIndex: index, Deleted: true})
+			for _, rec := range stack.Logs(u.name) {
+				t.Logs = append(t.Logs, &ReftableLog{Name: u.name, UpdateIndex: rec.UpdateIndex, Deleted: true})
+			}
+		default:
+			rec := &ReftableRef{Ref: Ref{Name: u.name, SHA1: u.new}, UpdateIndex: index}
+			if peeled, ok, err := r.peel(u.new); err == nil && ok {
+				rec.Commit = &peeled
+			}
+			t.Refs = append(t.Refs, rec)
+			e := ReflogEntry{Old: u.current, New: u.new, Committer: tx.committer, Message: tx.msg}
+			if r.shouldLogRef(u.name) {
+				t.Logs = append(t.Logs, &ReftableLog{ReflogEntry: e, Name: u.name, UpdateIndex: index})
+			}
+			if u.logHead && r.shouldLogRef("HEAD") {
+				t.Logs = append(t.Logs, &ReftableLog{ReflogEntry: e, Name: "HEAD", UpdateIndex: index})
+			}
+		}
+	}
+	if len(t.Refs) == 0 {
+		list.Rollback()
+		return nil
+	}
+	return b.addTable(tx, list, stack, t)
+}
+
+// commit moves the new table into place before tables.list refers to it.
+func (b *reftableRefBackend) commit(tx *RefTransaction) error {
+	for i := len(tx.locks) - 1; i >= 0; i-- {
+		if err := tx.locks[i].Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *reftableRefBackend) reflog(name string) ([]*ReflogEntry, error) {
+	stack, err := b.current()
+	if err != nil {
+		return nil, err
+	}
+	var entries []*ReflogEntry
+	for _, rec := range stack.Logs(name) {
+		e := rec.ReflogEntry
+		entries = append(entries, &e)
+	}
+	return entries, nil
+}
+
+func (b *reftableRefBackend) hasReflog(name string) bool {
+	stack, err := b.current()
+	return err == nil && len(stack.Logs(name)) > 0
+}
+
+func (b *reftableRefBackend) reflogNames() ([]string, error) {
+	stack, err := b.current()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range stack.logs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// expireReflog adds a table with deletion records for the expired entries.
+func (b *reftableRefBackend) expireReflog(name string, keep func(*ReflogEntry) bool) error {
+	tx := b.repo.RefTransaction()
+	defer tx.Abort()
+	list, stack, err := b.lockStack(tx)
+	if err != nil {
+		return err
+	}
+	index := stack.NextUpdateIndex()
+	t := &Reftable{}
+	t.Format, t.MinUpdateIndex, t.MaxUpdateIndex = b.repo.Format, index, index
+	for _, rec := range stack.Logs(name) {
+		if !keep(&rec.ReflogEntry) {
+			t.Logs = append(t.Logs, &ReftableLog{Name: name, UpdateIndex: rec.UpdateIndex, Deleted: true})
+		}
+	}
+	if len(t.Logs) == 0 {
+		return nil
+	}
+	if err = b.addTable(tx, list, stack, t); err != nil {
+		return err
+	}
+	return b.commit(tx)
+}
+
+// pack compacts the whole stack into a single table, dropping deletion
+// records which have nothing left to shadow.
+func (b *reftableRefBackend) pack(opts PackRefsOptions) error {
+	tx := b.repo.RefTransaction()
+	defer tx.Abort()
+	list, stack, err := b.lockStack(tx)
+	if err != nil {
+		return err
+	}
+	if len(stack.Tables) <= 1 {
+		return nil
+	}
+	for _, old := range stack.Tables {
+		if _, err = tx.lock(old.Path); err != nil {
+			return err
+		}
+	}
+
+	t := &Reftable{}
+	t.Format = b.repo.Format
+	t.MinUpdateIndex = stack.Tables[0].MinUpdateIndex
+	t.MaxUpdateIndex = stack.Tables[len(stack.Tables)-1].MaxUpdateIndex
+	for _, rec := range stack.refs {
+		t.Refs = append(t.Refs, rec)
+	}
+	for _, logs := range stack.logs {
+		t.Logs = append(t.Logs, logs...)
+	}
+	name := reftableName(t.MinUpdateIndex, t.MaxUpdateIndex)
+	lock, err := lockPath(filepath.Join(b.dir, name))
+	if err != nil {
+		return err
+	}
+	if err = t.Write(lock); err != nil {
+		lock.Rollback()
+		return err
+	}
+	if err = lock.Commit(); err != nil {
+		return err
+	}
+	if _, err = list.Write([]byte(name + "\n")); err != nil {
+		os.Remove(filepath.Join(b.dir, name))
+		return err
+	}
+	if err = list.Commit(); err != nil {
+		os.Remove(filepath.Join(b.dir, name))
+		return err
+	}
+	// readers which loaded the old list retry when the tables are gone
+	for _, old := range stack.Tables {
+		os.Remove(old.Path)
+	}
+	return nil
+}
+
+type reftableLogsByUpdateIndex []*ReftableLog
+
+func (s reftableLogsByUpdateIndex) Len() int           { return len(s) }
+func (s reftableLogsByUpdateIndex) Less(i, j int) bool { return s[i].UpdateIndex < s[j].UpdateIndex }
+func (s reftableLogsByUpdateIndex) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
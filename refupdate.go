@@ -0,0 +1,463 @@
+package git
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrRefLocked         = errors.New("Ref is locked by another process")
+	ErrTransactionClosed = errors.New("Ref transaction already closed")
+)
+
+// RefChangedError is returned when a ref does not hold the value expected by
+// a compare-and-swap update. A zero SHA1 stands for a ref which does not exist.
+type RefChangedError struct {
+	Name     string
+	Expected SHA1
+	Actual   SHA1
+}
+
+func (e *RefChangedError) Error() string {
+	return fmt.Sprintf("Ref %s changed: expected %s, found %s", e.Name, e.Expected, e.Actual)
+}
+
+// lockFile is a "<path>.lock" file which is renamed over path on commit,
+// the same protocol git uses to update refs and packed-refs atomically.
+type lockFile struct {
+	path string
+	f    *os.File
+	done bool
+}
+
+func lockPath(path string) (*lockFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		return nil, ErrRefLocked
+	} else if err != nil {
+		return nil, err
+	}
+	return &lockFile{path: path, f: f}, nil
+}
+
+func (l *lockFile) Write(b []byte) (int, error) {
+	return l.f.Write(b)
+}
+
+func (l *lockFile) Commit() error {
+	if l.done {
+		return nil
+	}
+	l.done = true
+	if err := l.f.Sync(); err != nil {
+		l.f.Close()
+		os.Remove(l.f.Name())
+		return err
+	}
+	if err := l.f.Close(); err != nil {
+		os.Remove(l.f.Name())
+		return err
+	}
+	if err := os.Rename(l.f.Name(), l.path); err != nil {
+		os.Remove(l.f.Name())
+		return err
+	}
+	return nil
+}
+
+// Rollback releases the lock unless it has been committed already.
+func (l *lockFile) Rollback() {
+	if l.done {
+		return
+	}
+	l.done = true
+	l.f.Close()
+	os.Remove(l.f.Name())
+}
+
+// RefTransaction updates several refs as a unit like git update-ref --stdin.
+// Prepare locks every ref involved and verifies their old values. Nothing
+// is changed unless all of them succeed. Commit then moves the locks into
+// place.
+type RefTransaction struct {
+	// Message and Committer are recorded in the reflogs. Committer defaults
+	// to the identity configured for the repository.
+	Message    string
+	Committer  *User
+	repo       *Repository
+	updates    []*refUpdate
+	locks      []*lockFile
+	packedLock *lockFile
+	committer  *User
+	msg        string
+	prepared   bool
+	closed     bool
+}
+
+type refUpdate struct {
+	name    string
+	new     SHA1
+	old     *SHA1
+	verify  bool
+	lock    *lockFile
+	current SHA1
+	logHead bool
+}
+
+func (u *refUpdate) deletion() bool {
+	return !u.verify && u.new.IsZero()
+}
+
+func (r *Repository) RefTransaction() *RefTransaction {
+	return &RefTransaction{repo: r}
+}
+
+// Update points the ref name at id. If old is not nil, the ref must still
+// hold *old, where a zero SHA1 requires the ref to be absent. Updating to a
+// zero SHA1 deletes the ref.
+func (tx *RefTransaction) Update(name string, id SHA1, old *SHA1) {
+	tx.updates = append(tx.updates, &refUpdate{name: name, new: id, old: old})
+}
+
+// Create creates the ref name, which must not exist yet.
+func (tx *RefTransaction) Create(name string, id SHA1) {
+	zero := tx.repo.Format.zero()
+	tx.Update(name, id, &zero)
+}
+
+// Delete removes the ref name.
+func (tx *RefTransaction) Delete(name string, old *SHA1) {
+	tx.Update(name, tx.repo.Format.zero(), old)
+}
+
+// Verify checks that the ref name holds old without changing it. A zero SHA1
+// requires the ref to be absent.
+func (tx *RefTransaction) Verify(name string, old SHA1) {
+	tx.updates = append(tx.updates, &refUpdate{name: name, old: &old, verify: true})
+}
+
+func (tx *RefTransaction) Prepare() error {
+	if tx.closed {
+		return ErrTransactionClosed
+	}
+	if tx.prepared {
+		return nil
+	}
+	if err := tx.prepare(); err != nil {
+		tx.Abort()
+		return err
+	}
+	tx.prepared = true
+	return nil
+}
+
+func (tx *RefTransaction) prepare() error {
+	r := tx.repo
+	names := make(map[string]bool)
+	for _, u := range tx.updates {
+		name, err := r.derefName(u.name)
+		if err != nil {
+			return err
+		}
+		if names[name] {
+			return fmt.Errorf("Multiple updates for ref %s not allowed", name)
+		}
+		names[name] = true
+		u.name = name
+	}
+	sort.Sort(refUpdatesByName(tx.updates))
+	head, _ := r.derefName("HEAD")
+	for _, u := range tx.updates {
+		if !u.deletion() && !u.verify {
+			if err := r.checkRefAvailable(u.name, names); err != nil {
+				return err
+			}
+			// HEAD pointing at the branch records the move in its reflog too
+			u.logHead = u.name == head && head != "HEAD"
+		}
+	}
+
+	tx.committer = tx.Committer
+	if tx.committer == nil {
+		tx.committer = r.defaultIdent()
+	}
+	tx.msg = strings.Join(strings.Fields(tx.Message), " ")
+	return r.refs.prepare(tx)
+}
+
+func (tx *RefTransaction) lock(path string) (*lockFile, error) {
+	lock, err := lockPath(path)
+	if err != nil {
+		return nil, err
+	}
+	tx.locks = append(tx.locks, lock)
+	return lock, nil
+}
+
+// Commit prepares the transaction if needed and applies it.
+func (tx *RefTransaction) Commit() error {
+	if err := tx.Prepare(); err != nil {
+		return err
+	}
+	defer tx.Abort()
+	return tx.repo.refs.commit(tx)
+}
+
+// Abort releases all locks held by the transaction. It is a no-op once the
+// transaction has been committed.
+func (tx *RefTransaction) Abort() {
+	tx.closed = true
+	for _, lock := range tx.locks {
+		lock.Rollback()
+	}
+}
+
+func (b *filesRefBackend) prepare(tx *RefTransaction) error {
+	// locks are taken in sorted order so that two transactions never wait
+	// for each other
+	var deletes map[string]bool
+	for _, u := range tx.updates {
+		lock, err := tx.lock(filepath.Join(b.root, u.name))
+		if err != nil {
+			return err
+		}
+		u.lock = lock
+		if u.deletion() {
+			if deletes == nil {
+				deletes = make(map[string]bool)
+			}
+			deletes[u.name] = true
+		}
+	}
+
+	b.packed = OpenPackedRefs(b.root)
+	for _, u := range tx.updates {
+		current, err := tx.repo.checkOldValue(u.name, u.old)
+		if err != nil {
+			return err
+		}
+		u.current = current
+		if !u.deletion() && !u.verify {
+			if _, err := u.lock.Write([]byte(u.new.String() + "\n")); err != nil {
+				return err
+			}
+		}
+	}
+	if deletes != nil {
+		lock, err := b.lockPackedRefsWithout(deletes)
+		if err != nil {
+			return err
+		}
+		if lock != nil {
+			tx.locks = append(tx.locks, lock)
+			tx.packedLock = lock
+		}
+	}
+	return nil
+}
+
+// commit deletes packed refs first so that a stale packed value is never
+// exposed.
+func (b *filesRefBackend) commit(tx *RefTransaction) error {
+	if tx.packedLock != nil {
+		if err := tx.packedLock.Commit(); err != nil {
+			return err
+		}
+		b.packed = OpenPackedRefs(b.root)
+	}
+	for _, u := range tx.updates {
+		switch {
+		case u.verify:
+			u.lock.Rollback()
+		case u.deletion():
+			path := filepath.Join(b.root, u.name)
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			u.lock.Rollback()
+			removeEmptyDirs(b.root, filepath.Dir(path))
+			if err := b.deleteReflog(u.name); err != nil {
+				return err
+			}
+		default:
+			e := &ReflogEntry{Old: u.current, New: u.new, Committer: tx.committer, Message: tx.msg}
+			if tx.repo.shouldLogRef(u.name) {
+				if err := b.appendReflog(u.name, e); err != nil {
+					return err
+				}
+			}
+			if u.logHead && tx.repo.shouldLogRef("HEAD") {
+				if err := b.appendReflog("HEAD", e); err != nil {
+					return err
+				}
+			}
+			if err := u.lock.Commit(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// UpdateRef points the ref name at id, following symbolic refs like
+// git update-ref, and records msg in the reflog. Old works the same as for
+// RefTransaction.Update.
+func (r *Repository) UpdateRef(name string, id SHA1, old *SHA1, msg string) error {
+	tx := r.RefTransaction()
+	tx.Message = msg
+	tx.Update(name, id, old)
+	return tx.Commit()
+}
+
+// DeleteRef removes the ref name. Old works the same as for
+// RefTransaction.Update.
+func (r *Repository) DeleteRef(name string, old *SHA1) error {
+	tx := r.RefTransaction()
+	tx.Delete(name, old)
+	return tx.Commit()
+}
+
+// derefName follows symbolic refs and returns the name of the ref to be
+// written, which may not exist yet.
+func (r *Repository) derefName(name string) (string, error) {
+	for i := 0; ; i++ {
+		if err := checkRefName(name); err != nil {
+			return "", err
+		}
+		ref, err := r.refs.rawRef(name)
+		if err == errRefNotFound {
+			return name, nil
+		} else if err != nil {
+			return "", err
+		}
+		if !ref.IsSymbolic() {
+			return name, nil
+		}
+		if i >= maxSymrefDepth {
+			return "", ErrRefLoop
+		}
+		name = ref.Target
+	}
+}
+
+// checkRefAvailable reports an error if creating name would clash with an
+// existing ref or another ref of the transaction, as refs/heads/a prevents
+// refs/heads/a/b from being created and vice versa.
+func (r *Repository) checkRefAvailable(name string, names map[string]bool) error {
+	for dir := path.Dir(name); dir != "." && dir != "refs"; dir = path.Dir(dir) {
+		if names[dir] {
+			return fmt.Errorf("Ref %s conflicts with %s", name, dir)
+		}
+		if ref, err := r.refs.rawRef(dir); err == nil {
+			return fmt.Errorf("Ref %s conflicts with %s", name, ref.Name)
+		}
+	}
+	for other := range names {
+		if strings.HasPrefix(other, name+"/") {
+			return fmt.Errorf("Ref %s conflicts with %s", name, other)
+		}
+	}
+	if other := r.refs.refUnder(name); other != "" {
+		return fmt.Errorf("Ref %s conflicts with %s", name, other)
+	}
+	return nil
+}
+
+// checkOldValue must be called while holding the lock of the ref. It
+// returns the current value of the ref, which is zero if it does not exist.
+func (r *Repository) checkOldValue(name string, old *SHA1) (SHA1, error) {
+	actual := r.Format.zero()
+	if ref, err := r.refs.rawRef(name); err == nil {
+		actual = ref.SHA1
+	} else if err != errRefNotFound {
+		return actual, err
+	}
+	if old == nil {
+		return actual, nil
+	}
+	expected := *old
+	if expected.IsZero() {
+		expected = r.Format.zero()
+	}
+	if actual != expected {
+		return actual, &RefChangedError{Name: name, Expected: expected, Actual: actual}
+	}
+	return actual, nil
+}
+
+// lockPackedRefsWithout locks packed-refs and writes its content without the
+// given refs and their peeled lines into the lock. The file is kept as is
+// otherwise, including its header. It returns nil if there is nothing to
+// remove.
+func (b *filesRefBackend) lockPackedRefsWithout(names map[string]bool) (*lockFile, error) {
+	path := filepath.Join(b.root, "packed-refs")
+	lock, err := lockPath(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		lock.Rollback()
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	removed, skipPeeled := false, false
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		if line[0] == '^' && skipPeeled {
+			continue
+		}
+		skipPeeled = false
+		if fields := strings.Fields(line); line[0] != '#' && line[0] != '^' && len(fields) == 2 && names[fields[1]] {
+			removed, skipPeeled = true, true
+			continue
+		}
+		out.WriteString(line)
+	}
+	if !removed {
+		lock.Rollback()
+		return nil, nil
+	}
+	if _, err = lock.Write(out.Bytes()); err != nil {
+		lock.Rollback()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// removeEmptyDirs removes directories left empty by a deleted ref, up to
+// but excluding the top level namespace under base such as refs/heads.
+func removeEmptyDirs(base, dir string) {
+	for {
+		rel, err := filepath.Rel(base, dir)
+		if err != nil || strings.Count(filepath.ToSlash(rel), "/") < 2 {
+			return
+		}
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+type refUpdatesByName []*refUpdate
+
+func (s refUpdatesByName) Len() int           { return len(s) }
+func (s refUpdatesByName) Less(i, j int) bool { return s[i].name < s[j].name }
+func (s refUpdatesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
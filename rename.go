@@ -0,0 +1,400 @@
+package git
+
+import (
+	"bytes"
+	"path"
+	"sort"
+)
+
+const (
+	// maxRenameScore is the similarity of identical files as git scales it.
+	maxRenameScore = 60000
+	// renameCandidates is the number of best sources kept for each
+	// destination.
+	renameCandidates = 4
+	// spanHashBase is the modulus of the hashes of file chunks.
+	spanHashBase = 107927
+
+	defaultRenameThreshold = 50
+	defaultRenameLimit     = 1000
+)
+
+type renameSource struct {
+	change  *Change
+	deleted bool
+	used    int
+	blob    *renameBlob
+}
+
+type renameDest struct {
+	change *Change
+	src    *renameSource
+	score  int
+	blob   *renameBlob
+}
+
+type renameScore struct {
+	dst, src  int
+	score     int
+	nameScore int
+}
+
+// renameBlob caches the contents of a file and its chunk hashes.
+type renameBlob struct {
+	id    SHA1
+	data  []byte
+	read  bool
+	spans map[uint32]uint64
+}
+
+// detectRenames pairs removed and added files like git diffcore-rename.
+// Identical files are paired first, then files whose contents are similar
+// enough. Unless copies are wanted, added files whose basename appears
+// only once on each side are tried with a higher threshold before the
+// others.
+func (d *treeDiff) detectRenames(opts DiffOptions) error {
+	copies := opts.DetectCopies
+	minScore := opts.RenameThreshold * maxRenameScore / 100
+	if opts.RenameThreshold == 0 {
+		minScore = defaultRenameThreshold * maxRenameScore / 100
+	}
+	limit := opts.RenameLimit
+	if limit == 0 {
+		limit = defaultRenameLimit
+	}
+
+	var (
+		srcs  []*renameSource
+		dsts  []*renameDest
+		blobs = make(map[SHA1]*renameBlob)
+	)
+	blob := func(id SHA1) *renameBlob {
+		if b, ok := blobs[id]; ok {
+			return b
+		}
+		b := &renameBlob{id: id}
+		blobs[id] = b
+		return b
+	}
+	for _, c := range d.changes {
+		switch {
+		case c.Type == ChangeAdd:
+			dsts = append(dsts, &renameDest{change: c, blob: blob(c.NewID)})
+		case c.Type == ChangeDelete:
+			srcs = append(srcs, &renameSource{change: c, deleted: true, blob: blob(c.OldID)})
+		case copies:
+			// the file itself is one of the users of the source
+			srcs = append(srcs, &renameSource{change: c, used: 1, blob: blob(c.OldID)})
+		}
+	}
+	if len(srcs) == 0 || len(dsts) == 0 {
+		return nil
+	}
+	record := func(dst *renameDest, src *renameSource, score int) {
+		dst.src, dst.score = src, score
+		src.used++
+	}
+
+	// exact renames, preferring unused sources and then the same basename
+	for _, dst := range dsts {
+		var best *renameSource
+		bestScore := -1
+		for _, src := range srcs {
+			if src.change.OldID != dst.change.NewID || src.change.OldMode&0170000 != dst.change.NewMode&0170000 {
+				continue
+			}
+			if src.used > 0 && !copies {
+				continue
+			}
+			score := basenameSame(src.change.OldPath, dst.change.NewPath)
+			if src.used == 0 {
+				score++
+			}
+			if score > bestScore {
+				best, bestScore = src, score
+			}
+		}
+		if best != nil {
+			record(dst, best, maxRenameScore)
+		}
+	}
+
+	candidates := srcs
+	if !copies {
+		candidates = unusedRenameSources(candidates)
+		if err := d.findBasenameRenames(candidates, dsts, minScore+(maxRenameScore-minScore)/2, record); err != nil {
+			return err
+		}
+		candidates = unusedRenameSources(candidates)
+	}
+
+	var pending []*renameDest
+	for _, dst := range dsts {
+		if dst.src == nil {
+			pending = append(pending, dst)
+		}
+	}
+	if limit > 0 && len(pending)*len(candidates) > limit*limit {
+		candidates = nil
+	}
+	if len(pending) > 0 && len(candidates) > 0 {
+		var scores []renameScore
+		for i, dst := range pending {
+			best := make([]renameScore, renameCandidates)
+			for k := range best {
+				best[k].dst = -1
+			}
+			for j, src := range candidates {
+				if src.used > 0 && !copies {
+					continue
+				}
+				score, err := d.similarity(src, dst, minScore)
+				if err != nil {
+					return err
+				}
+				recordIfBetter(best, renameScore{
+					dst:       i,
+					src:       j,
+					score:     score,
+					nameScore: basenameSame(src.change.OldPath, dst.change.NewPath),
+				})
+			}
+			scores = append(scores, best...)
+		}
+		sort.SliceStable(scores, func(i, j int) bool {
+			return compareRenameScores(scores[i], scores[j]) < 0
+		})
+		find := func(copies bool) {
+			for _, m := range scores {
+				if m.dst < 0 || m.score < minScore {
+					break
+				}
+				dst, src := pending[m.dst], candidates[m.src]
+				if dst.src != nil || (!copies && src.used > 0) {
+					continue
+				}
+				record(dst, src, m.score)
+			}
+		}
+		find(false)
+		if copies {
+			find(true)
+		}
+	}
+
+	// replace the added files with the pairs found, and drop the deleted
+	// files which have been renamed
+	renamed := make(map[*Change]*renameDest)
+	for _, dst := range dsts {
+		if dst.src != nil {
+			renamed[dst.change] = dst
+		}
+	}
+	gone := make(map[*Change]bool)
+	for _, src := range srcs {
+		gone[src.change] = src.deleted && src.used > 0
+	}
+	var changes []*Change
+	for _, c := range d.changes {
+		if gone[c] {
+			continue
+		}
+		dst, ok := renamed[c]
+		if !ok {
+			changes = append(changes, c)
+			continue
+		}
+		old := dst.src.change
+		pair := *c
+		pair.OldPath, pair.OldMode, pair.OldID = old.OldPath, old.OldMode, old.OldID
+		pair.Score = dst.score * 100 / maxRenameScore
+		if dst.src.used--; dst.src.used > 0 {
+			pair.Type = ChangeCopy
+		} else {
+			pair.Type = ChangeRename
+		}
+		changes = append(changes, &pair)
+	}
+	d.changes = changes
+	return nil
+}
+
+// findBasenameRenames pairs files whose basename is unique among both the
+// sources and the destinations when they are at least minScore similar.
+func (d *treeDiff) findBasenameRenames(srcs []*renameSource, dsts []*renameDest, minScore int, record func(*renameDest, *renameSource, int)) error {
+	srcIndex := make(map[string]int)
+	for i, src := range srcs {
+		base := path.Base(src.change.OldPath)
+		if _, ok := srcIndex[base]; ok {
+			srcIndex[base] = -1
+		} else {
+			srcIndex[base] = i
+		}
+	}
+	dstIndex := make(map[string]int)
+	for i, dst := range dsts {
+		if dst.src != nil {
+			continue
+		}
+		base := path.Base(dst.change.NewPath)
+		if _, ok := dstIndex[base]; ok {
+			dstIndex[base] = -1
+		} else {
+			dstIndex[base] = i
+		}
+	}
+	for i, src := range srcs {
+		base := path.Base(src.change.OldPath)
+		j, ok := dstIndex[base]
+		if !ok || j == -1 || srcIndex[base] != i || dsts[j].src != nil {
+			continue
+		}
+		score, err := d.similarity(src, dsts[j], minScore)
+		if err != nil {
+			return err
+		}
+		if score >= minScore {
+			record(dsts[j], src, score)
+		}
+	}
+	return nil
+}
+
+func unusedRenameSources(srcs []*renameSource) []*renameSource {
+	var unused []*renameSource
+	for _, src := range srcs {
+		if src.used == 0 {
+			unused = append(unused, src)
+		}
+	}
+	return unused
+}
+
+// similarity estimates how much of dst comes from src, scaled to
+// maxRenameScore. Only regular files are compared, and files whose sizes
+// differ too much to reach minScore are not read.
+func (d *treeDiff) similarity(s *renameSource, t *renameDest, minScore int) (int, error) {
+	if s.change.OldMode&0170000 != 0100000 || t.change.NewMode&0170000 != 0100000 {
+		return 0, nil
+	}
+	src, dst := s.blob, t.blob
+	if err := d.readRenameBlob(src); err != nil {
+		return 0, err
+	}
+	if err := d.readRenameBlob(dst); err != nil {
+		return 0, err
+	}
+	maxSize, baseSize := uint64(len(src.data)), uint64(len(dst.data))
+	if maxSize < baseSize {
+		maxSize, baseSize = baseSize, maxSize
+	}
+	if maxSize*uint64(maxRenameScore-minScore) < (maxSize-baseSize)*maxRenameScore {
+		return 0, nil
+	}
+	if len(dst.data) == 0 {
+		return 0, nil
+	}
+	if src.spans == nil {
+		src.spans = spanHashes(src.data)
+	}
+	if dst.spans == nil {
+		dst.spans = spanHashes(dst.data)
+	}
+	var copied uint64
+	for hash, n := range src.spans {
+		if m := dst.spans[hash]; m < n {
+			copied += m
+		} else {
+			copied += n
+		}
+	}
+	return int(copied * maxRenameScore / maxSize), nil
+}
+
+func (d *treeDiff) readRenameBlob(b *renameBlob) error {
+	if b.read {
+		return nil
+	}
+	obj, err := d.repo.Object(b.id)
+	if err != nil {
+		return err
+	}
+	blob, ok := obj.(*Blob)
+	if !ok {
+		return ErrUnknownFormat
+	}
+	b.data, b.read = blob.Data, true
+	return nil
+}
+
+// spanHashes splits data into lines, or chunks of 64 bytes for long lines,
+// and counts the bytes of the chunks by their hashes like git. The CR of a
+// CRLF is ignored in text files, and so is an incomplete last line as git
+// does.
+func spanHashes(data []byte) map[uint32]uint64 {
+	spans := make(map[uint32]uint64)
+	text := !isBinary(data)
+	var accum1, accum2 uint32
+	n := 0
+	for i, c := range data {
+		if text && c == '\r' && i+1 < len(data) && data[i+1] == '\n' {
+			continue
+		}
+		old := accum1
+		accum1 = (accum1 << 7) ^ (accum2 >> 25)
+		accum2 = (accum2 << 7) ^ (old >> 25)
+		accum1 += uint32(c)
+		if n++; n < 64 && c != '\n' {
+			continue
+		}
+		spans[(accum1+accum2*0x61)%spanHashBase] += uint64(n)
+		n, accum1, accum2 = 0, 0, 0
+	}
+	return spans
+}
+
+// isBinary reports whether data looks binary to git, i.e. there is a NUL
+// byte in the first 8000 bytes.
+func isBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) != -1
+}
+
+func basenameSame(a, b string) int {
+	if path.Base(a) == path.Base(b) {
+		return 1
+	}
+	return 0
+}
+
+// recordIfBetter replaces the worst of the candidates with m if m is
+// better.
+func recordIfBetter(best []renameScore, m renameScore) {
+	worst := 0
+	for i := 1; i < len(best); i++ {
+		if compareRenameScores(best[i], best[worst]) > 0 {
+			worst = i
+		}
+	}
+	if compareRenameScores(best[worst], m) > 0 {
+		best[worst] = m
+	}
+}
+
+// compareRenameScores orders higher scores first and unused slots last.
+func compareRenameScores(a, b renameScore) int {
+	if a.dst < 0 {
+		if b.dst >= 0 {
+			return 1
+		}
+		return 0
+	} else if b.dst < 0 {
+		return -1
+	}
+	if a.score == b.score {
+		return b.nameScore - a.nameScore
+	}
+	return b.score - a.score
+}
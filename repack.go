@@ -0,0 +1,318 @@
+package git
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	DefaultRepackWindow = 10
+	DefaultRepackDepth  = 50
+)
+
+// repackMinDeltaSize is the size below which objects are not deltified,
+// since a delta would hardly be smaller, like git.
+const repackMinDeltaSize = 50
+
+type RepackOptions struct {
+	Window       int
+	Depth        int
+	NoReuseDelta bool
+}
+
+type repackObject struct {
+	id         SHA1
+	typ        string
+	size       int
+	nameHash   uint32
+	pack       *Pack
+	raw        *packRawEntry
+	base       *repackObject
+	delta      []byte
+	depth      int
+	dependents int
+	offset     int64
+	written    bool
+}
+
+// Repack writes every reachable object into a single new pack and removes
+// the packs it replaces. Packs with a .keep file are left untouched, and
+// the objects in them are not copied.
+func (r *Repository) Repack(opts RepackOptions) error {
+	if opts.Window <= 0 {
+		opts.Window = DefaultRepackWindow
+	}
+	if opts.Depth <= 0 {
+		opts.Depth = DefaultRepackDepth
+	}
+
+	if _, err := r.openPacks(); err != nil {
+		return err
+	}
+	var old, kept []*Pack
+	for _, pack := range r.packs {
+		if _, err := os.Stat(strings.TrimSuffix(pack.path, ".pack") + ".keep"); err == nil {
+			kept = append(kept, pack)
+		} else {
+			old = append(old, pack)
+		}
+	}
+
+	roots, weak, err := r.reachabilityRoots()
+	if err != nil {
+		return err
+	}
+	var objs []*repackObject
+	byID := make(map[SHA1]*repackObject)
+	err = r.walkObjects(roots, weak, func(id SHA1, typ string, data []byte, path string) error {
+		// objects in kept packs stay there, like git pack-objects
+		// --honor-pack-keep
+		for _, pack := range kept {
+			if pack.idx.Entry(id) != nil {
+				return nil
+			}
+		}
+		obj := &repackObject{
+			id:       id,
+			typ:      typ,
+			size:     len(data),
+			nameHash: packNameHash(path),
+		}
+		objs = append(objs, obj)
+		byID[id] = obj
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, pack := range old {
+		entries, err := pack.rawEntries()
+		if err != nil {
+			return err
+		}
+		for id, e := range entries {
+			if obj := byID[id]; obj != nil && obj.raw == nil {
+				obj.pack, obj.raw = pack, e
+			}
+		}
+	}
+
+	if !opts.NoReuseDelta {
+		r.reuseDeltas(objs, byID, opts.Depth)
+	}
+	if err = r.findDeltas(objs, opts); err != nil {
+		return err
+	}
+
+	var path string
+	if len(objs) > 0 {
+		if path, err = r.writeRepack(objs); err != nil {
+			return err
+		}
+	}
+
+	removed := make(map[*Pack]bool)
+	for _, pack := range old {
+		if pack.path == path {
+			continue
+		}
+		base := strings.TrimSuffix(pack.path, ".pack")
+		for _, ext := range []string{".pack", ".idx", ".bitmap", ".rev"} {
+			if err := os.Remove(base + ext); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		pack.Close()
+		removed[pack] = true
+	}
+	var packs []*Pack
+	for _, pack := range r.packs {
+		if !removed[pack] {
+			packs = append(packs, pack)
+		}
+	}
+	r.packs = packs
+	return nil
+}
+
+func (r *Repository) reuseDeltas(objs []*repackObject, byID map[SHA1]*repackObject, maxDepth int) {
+	for _, obj := range objs {
+		if obj.raw == nil || (obj.raw.typ != packEntryOfsDelta && obj.raw.typ != packEntryRefDelta) {
+			continue
+		}
+		if base := byID[obj.raw.base]; base != nil {
+			obj.base = base
+		}
+	}
+	// drop reused deltas forming a cycle across packs or exceeding the depth
+	for _, obj := range objs {
+		depth := 0
+		seen := map[*repackObject]bool{obj: true}
+		for base := obj.base; base != nil; base = base.base {
+			if seen[base] || depth >= maxDepth {
+				obj.base = nil
+				break
+			}
+			seen[base] = true
+			depth++
+		}
+	}
+	for _, obj := range objs {
+		if obj.base != nil {
+			obj.base.dependents++
+		}
+	}
+	for _, obj := range objs {
+		for base := obj.base; base != nil; base = base.base {
+			obj.depth++
+		}
+	}
+}
+
+func (r *Repository) findDeltas(objs []*repackObject, opts RepackOptions) error {
+	var candidates []*repackObject
+	for _, obj := range objs {
+		if obj.base == nil && obj.dependents == 0 && obj.size >= repackMinDeltaSize {
+			candidates = append(candidates, obj)
+		}
+	}
+	sort.Sort(repackObjectsByType(candidates))
+
+	type windowEntry struct {
+		obj  *repackObject
+		data []byte
+	}
+	var window []windowEntry
+	for _, obj := range candidates {
+		_, data, err := r.readRaw(obj.id)
+		if err != nil {
+			return err
+		}
+
+		maxSize := obj.size/2 - r.Format.Size()
+		for i := len(window) - 1; i >= 0; i-- {
+			w := window[i]
+			if w.obj.typ != obj.typ || w.obj.depth >= opts.Depth || obj.size < w.obj.size/32 {
+				continue
+			}
+			if delta := createDelta(w.data, data, maxSize); delta != nil {
+				obj.base, obj.delta, obj.depth = w.obj, delta, w.obj.depth+1
+				maxSize = len(delta) - 1
+			}
+		}
+
+		window = append(window, windowEntry{obj: obj, data: data})
+		if len(window) > opts.Window {
+			window = window[1:]
+		}
+	}
+	return nil
+}
+
+func (r *Repository) writeRepack(objs []*repackObject) (string, error) {
+	dir := filepath.Join(r.root, "objects", "pack")
+	packFile, err := ioutil.TempFile(dir, "tmp_pack_")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(packFile.Name())
+	defer packFile.Close()
+
+	bw := bufio.NewWriter(packFile)
+	pw, err := NewPackWriter(bw, r.Format, uint32(len(objs)))
+	if err != nil {
+		return "", err
+	}
+	for _, obj := range objs {
+		if err = r.writeRepackObject(pw, obj); err != nil {
+			return "", err
+		}
+	}
+	sum, err := pw.Close()
+	if err != nil {
+		return "", err
+	}
+	if err = bw.Flush(); err != nil {
+		return "", err
+	}
+	return r.installPack(pw, packFile, sum)
+}
+
+func (r *Repository) writeRepackObject(pw *PackWriter, obj *repackObject) error {
+	if obj.written {
+		return nil
+	}
+	if obj.base != nil {
+		if err := r.writeRepackObject(pw, obj.base); err != nil {
+			return err
+		}
+	}
+	obj.offset = pw.offset
+	obj.written = true
+
+	switch {
+	case obj.delta != nil:
+		return pw.writeEntry(obj.id, packEntryOfsDelta, int64(len(obj.delta)), encodeDeltaOffset(obj.offset-obj.base.offset), obj.delta)
+	case obj.base != nil:
+		raw, err := obj.pack.readRawEntry(obj.raw)
+		if err != nil {
+			return err
+		}
+		entry := encodePackEntryHeader(packEntryOfsDelta, obj.raw.size)
+		entry = append(entry, encodeDeltaOffset(obj.offset-obj.base.offset)...)
+		entry = append(entry, raw[obj.raw.data-obj.raw.offset:]...)
+		return pw.writeRaw(obj.id, entry)
+	case obj.raw != nil && obj.raw.typ != packEntryOfsDelta && obj.raw.typ != packEntryRefDelta:
+		raw, err := obj.pack.readRawEntry(obj.raw)
+		if err != nil {
+			return err
+		}
+		return pw.writeRaw(obj.id, raw)
+	}
+	typ, data, err := r.readRaw(obj.id)
+	if err != nil {
+		return err
+	}
+	return pw.writeEntry(obj.id, packEntryTypeOf(typ), int64(len(data)), nil, data)
+}
+
+func encodeDeltaOffset(ofs int64) []byte {
+	buf := []byte{byte(ofs & 0x7f)}
+	for ofs >>= 7; ofs > 0; ofs >>= 7 {
+		ofs--
+		buf = append([]byte{byte(0x80 | ofs&0x7f)}, buf...)
+	}
+	return buf
+}
+
+// packNameHash groups objects by the tail of their path, like git does when
+// looking for delta candidates.
+func packNameHash(name string) uint32 {
+	var hash uint32
+	for _, c := range []byte(name) {
+		if unicode.IsSpace(rune(c)) {
+			continue
+		}
+		hash = (hash >> 2) + uint32(c)<<24
+	}
+	return hash
+}
+
+type repackObjectsByType []*repackObject
+
+func (s repackObjectsByType) Len() int      { return len(s) }
+func (s repackObjectsByType) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s repackObjectsByType) Less(i, j int) bool {
+	if s[i].typ != s[j].typ {
+		return s[i].typ < s[j].typ
+	}
+	if s[i].nameHash != s[j].nameHash {
+		return s[i].nameHash < s[j].nameHash
+	}
+	return s[i].size > s[j].size
+}
@@ -2,7 +2,6 @@ package git
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,11 +11,26 @@ import (
 )
 
 type Repository struct {
-	Path       string
-	Bare       bool
-	root       string
-	pack       *Pack
-	packedRefs *PackedRefs
+	Path          string
+	Bare          bool
+	Format        ObjectFormat
+	VerifyObjects bool
+	root          string
+	config        *Config
+	packs         []*Pack
+	packsOpen     bool
+	refs          refBackend
+	graph         *CommitGraph
+	graphOpen     bool
+}
+
+type CorruptObjectError struct {
+	ID     SHA1
+	Actual SHA1
+}
+
+func (e *CorruptObjectError) Error() string {
+	return fmt.Sprintf("Corrupt object %s: content hashes to %s", e.ID, e.Actual)
 }
 
 func Open(path string) (*Repository, error) {
@@ -33,14 +47,9 @@ func Open(path string) (*Repository, error) {
 		Path: path,
 		root: path,
 	}
-	defer func() {
-		if repo != nil {
-			repo.packedRefs = OpenPackedRefs(repo.root)
-		}
-	}()
 	if strings.HasSuffix(path, ".git") {
 		repo.Bare = true
-		return repo, nil
+		return repo, repo.setup()
 	}
 
 	files, err := ioutil.ReadDir(path)
@@ -50,75 +59,248 @@ func Open(path string) (*Repository, error) {
 	for _, file := range files {
 		if file.Name() == ".git" {
 			repo.root = filepath.Join(repo.root, ".git")
-			return repo, nil
+			return repo, repo.setup()
 		}
 	}
 	return nil, fmt.Errorf("Not a git repository: %s", path)
 }
 
+func (r *Repository) setup() error {
+	config, err := OpenConfig(filepath.Join(r.root, "config"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		config = new(Config)
+	}
+	r.config = config
+
+	switch format := strings.ToLower(config.Get("extensions.objectformat")); format {
+	case "", "sha1":
+		r.Format = FormatSHA1
+	case "sha256":
+		r.Format = FormatSHA256
+	default:
+		return fmt.Errorf("Unknown object format: %s", format)
+	}
+
+	switch storage := strings.ToLower(config.Get("extensions.refstorage")); storage {
+	case "", "files":
+		r.refs = newFilesRefBackend(r)
+	case "reftable":
+		r.refs = newReftableRefBackend(r)
+	default:
+		return fmt.Errorf("Unknown ref storage: %s", storage)
+	}
+	return nil
+}
+
 func (r *Repository) Object(id SHA1) (Object, error) {
-	return r.readObject(id, nil, false)
+	return r.readObject(id, nil)
 }
 
 func (r *Repository) Resolve(obj Object) error {
 	if obj.Resolved() {
 		return nil
 	}
-	_, err := r.readObject(obj.SHA1(), obj, false)
+	_, err := r.readObject(obj.SHA1(), obj)
 	return err
 }
 
-func (r *Repository) readObject(id SHA1, obj Object, headerOnly bool) (Object, error) {
-	var (
-		entry objectEntry
-		err   error
-	)
-	entry, err = newLooseObjectEntry(r.root, id)
+func (r *Repository) readObject(id SHA1, obj Object) (Object, error) {
+	typ, data, err := r.readRaw(id)
 	if err != nil {
-		if r.pack == nil {
-			if err = r.openPack(); err != nil {
-				return nil, err
-			}
-		}
-		if entry, err = r.pack.entry(id); err != nil {
+		return nil, err
+	}
+	if r.VerifyObjects {
+		if err = r.verifyObject(id, typ, data); err != nil {
 			return nil, err
 		}
 	}
-	defer entry.Close()
 
 	if obj == nil {
-		obj = newObject(entry.Type(), id, r)
+		if !validObjectType(typ) {
+			return nil, ErrUnknownFormat
+		}
+		obj = newObject(typ, id, r)
 	}
+	err = obj.Parse(data)
+	return obj, err
+}
 
-	if headerOnly {
-		return obj, nil
+func (r *Repository) readRaw(id SHA1) (string, []byte, error) {
+	entry, err := r.objectEntry(id)
+	if err != nil {
+		return "", nil, err
 	}
+	defer entry.Close()
 
 	buf := new(bytes.Buffer)
 	if _, err = io.Copy(buf, entry.Reader()); err != nil {
+		return "", nil, err
+	}
+	return entry.Type(), buf.Bytes(), nil
+}
+
+func (r *Repository) objectEntry(id SHA1) (objectEntry, error) {
+	if entry, err := newLooseObjectEntry(r.root, id); err == nil {
+		return entry, nil
+	}
+	entry, err := r.packEntry(id)
+	if err == ErrObjectNotFound {
+		// the object may have been moved into a new pack since packs were opened
+		var added bool
+		if added, err = r.openPacks(); err != nil {
+			return nil, err
+		}
+		if !added {
+			return nil, ErrObjectNotFound
+		}
+		entry, err = r.packEntry(id)
+	}
+	if err != nil {
 		return nil, err
 	}
-	err = obj.Parse(buf.Bytes())
-	return obj, err
+	return entry, nil
+}
+
+// objectSize returns the size of an object reading only its header.
+func (r *Repository) objectSize(id SHA1) (int64, error) {
+	if entry, err := newLooseObjectEntry(r.root, id); err == nil {
+		entry.Close()
+		return entry.size, nil
+	}
+	if !r.packsOpen {
+		if _, err := r.openPacks(); err != nil {
+			return 0, err
+		}
+	}
+	for {
+		for _, pack := range r.packs {
+			if e := pack.idx.Entry(id); e != nil {
+				return pack.sizeAt(e.Offset)
+			}
+		}
+		// the object may have been moved into a new pack since packs were opened
+		if added, err := r.openPacks(); err != nil {
+			return 0, err
+		} else if !added {
+			return 0, ErrObjectNotFound
+		}
+	}
 }
 
-func (r *Repository) openPack() error {
+func (r *Repository) packEntry(id SHA1) (*packEntry, error) {
+	if !r.packsOpen {
+		if _, err := r.openPacks(); err != nil {
+			return nil, err
+		}
+	}
+	for _, pack := range r.packs {
+		if entry, err := pack.entry(id); err != ErrObjectNotFound {
+			return entry, err
+		}
+	}
+	return nil, ErrObjectNotFound
+}
+
+func (r *Repository) packed(id SHA1) bool {
+	for _, pack := range r.packs {
+		if pack.idx.Entry(id) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Repository) verifyObject(id SHA1, typ string, data []byte) error {
+	actual, err := HashObject(r.Format, typ, data)
+	if err != nil {
+		return err
+	}
+	if actual != id {
+		return &CorruptObjectError{ID: id, Actual: actual}
+	}
+	return nil
+}
+
+func (r *Repository) objectIDs() ([]SHA1, error) {
+	if !r.packsOpen {
+		if _, err := r.openPacks(); err != nil {
+			return nil, err
+		}
+	}
+	var ids []SHA1
+	for _, pack := range r.packs {
+		ids = append(ids, pack.idx.Objects...)
+	}
+	loose, err := r.looseObjects()
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range loose {
+		ids = append(ids, obj.id)
+	}
+	return ids, nil
+}
+
+// openPacks opens pack files which are not opened yet. Packs already opened
+// are kept even if removed from disk since their file handles stay valid.
+func (r *Repository) openPacks() (bool, error) {
+	r.packsOpen = true
 	pattern := filepath.Join(r.root, "objects", "pack", "pack-*.pack")
 	files, err := filepath.Glob(pattern)
 	if err != nil {
-		return err
+		return false, err
 	}
-	switch len(files) {
-	case 0: // set empty pack
-		r.pack = &Pack{idx: &PackIndexV2{}}
-	case 1:
-		pack, err := OpenPack(files[0])
+	opened := make(map[string]bool)
+	for _, pack := range r.packs {
+		opened[pack.path] = true
+	}
+	var added bool
+	for _, file := range files {
+		if opened[file] {
+			continue
+		}
+		pack, err := OpenPack(file, r.Format)
+		if os.IsNotExist(err) { // being replaced by another process
+			continue
+		} else if err != nil {
+			return added, err
+		}
+		r.packs = append(r.packs, pack)
+		added = true
+	}
+	return added, nil
+}
+
+// shallowCommits returns the commits listed in the shallow file of a
+// shallow clone, whose parents are not in the repository.
+func (r *Repository) shallowCommits() (map[SHA1]bool, error) {
+	shallow := make(map[SHA1]bool)
+	data, err := ioutil.ReadFile(filepath.Join(r.root, "shallow"))
+	if os.IsNotExist(err) {
+		return shallow, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Fields(string(data)) {
+		id, err := NewSHA1(line)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		r.pack = pack
-	default:
-		return errors.New("Found more than 1 pack file")
+		shallow[id] = true
 	}
-	return nil
+	return shallow, nil
+}
+
+func (r *Repository) commitGraph() *CommitGraph {
+	if !r.graphOpen {
+		r.graphOpen = true
+		graph, err := OpenCommitGraph(filepath.Join(r.root, "objects", "info", "commit-graph"))
+		if err == nil && graph.Format == r.Format {
+			r.graph = graph
+		}
+	}
+	return r.graph
 }
@@ -0,0 +1,707 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrAmbiguousObjectID = errors.New("Ambiguous object id")
+
+// RevisionError reports a revision which cannot be parsed or resolved. Pos
+// is the byte offset in Revision where the problem was found.
+type RevisionError struct {
+	Revision string
+	Pos      int
+	Reason   string
+}
+
+func (e *RevisionError) Error() string {
+	return fmt.Sprintf("Invalid revision %q at %d: %s", e.Revision, e.Pos, e.Reason)
+}
+
+// dwimRefRules are the places a short ref name is looked up, in order.
+var dwimRefRules = []string{
+	"%s",
+	"refs/%s",
+	"refs/tags/%s",
+	"refs/heads/%s",
+	"refs/remotes/%s",
+	"refs/remotes/%s/HEAD",
+}
+
+// ResolveRevision returns the object named by rev in the syntax of
+// gitrevisions(7), e.g. "HEAD~3", "main^2", "v1.2^{tree}", "HEAD:path",
+// "@{-1}", "main@{upstream}", ":/fix typo" or an abbreviated object id.
+func (r *Repository) ResolveRevision(rev string) (Object, error) {
+	p := &revParser{repo: r, rev: rev}
+	return p.parse()
+}
+
+type revParser struct {
+	repo *Repository
+	rev  string
+}
+
+func (p *revParser) errorf(pos int, format string, args ...interface{}) error {
+	return &RevisionError{Revision: p.rev, Pos: pos, Reason: fmt.Sprintf(format, args...)}
+}
+
+func (p *revParser) parse() (Object, error) {
+	rev := p.rev
+	if strings.HasPrefix(rev, ":/") {
+		starts, err := p.allCommits()
+		if err != nil {
+			return nil, err
+		}
+		return p.search(starts, rev[2:], 2)
+	}
+	if strings.HasPrefix(rev, ":") {
+		return nil, p.errorf(0, "index lookups are not supported")
+	}
+
+	colon := -1
+	for i, depth := 0, 0; i < len(rev) && colon == -1; i++ {
+		switch rev[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth > 0 {
+				depth--
+			}
+		case ':':
+			if depth == 0 {
+				colon = i
+			}
+		}
+	}
+	if colon == -1 {
+		return p.expr(rev)
+	}
+
+	obj, err := p.expr(rev[:colon])
+	if err != nil {
+		return nil, err
+	}
+	tree, err := p.peel(obj, "tree", colon)
+	if err != nil {
+		return nil, err
+	}
+	path := strings.Trim(rev[colon+1:], "/")
+	if path == "" {
+		return tree, nil
+	}
+	found, err := tree.(*Tree).Find(path)
+	if err == ErrObjectNotFound {
+		return nil, p.errorf(colon+1, "path %s does not exist in %s", path, rev[:colon])
+	} else if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// expr resolves a revision followed by any number of ~<n>, ^<n> and
+// ^{...} suffixes.
+func (p *revParser) expr(s string) (Object, error) {
+	end := len(s)
+	for i, depth := 0, 0; i < len(s); i++ {
+		if s[i] == '{' {
+			depth++
+		} else if s[i] == '}' && depth > 0 {
+			depth--
+		} else if depth == 0 && (s[i] == '~' || s[i] == '^') {
+			end = i
+			break
+		}
+	}
+	obj, err := p.base(s[:end])
+	if err != nil {
+		return nil, err
+	}
+
+	for pos := end; pos < len(s); {
+		op := s[pos]
+		if op == '^' && pos+1 < len(s) && s[pos+1] == '{' {
+			close := matchingBrace(s, pos+1)
+			if close == -1 {
+				return nil, p.errorf(pos+1, "missing '}'")
+			}
+			if obj, err = p.peelSpec(obj, s[pos+2:close], pos+2); err != nil {
+				return nil, err
+			}
+			pos = close + 1
+			continue
+		}
+		if op != '~' && op != '^' {
+			return nil, p.errorf(pos, "unexpected %q", op)
+		}
+		start := pos + 1
+		pos = start
+		for pos < len(s) && s[pos] >= '0' && s[pos] <= '9' {
+			pos++
+		}
+		n := 1
+		if pos > start {
+			if n, err = strconv.Atoi(s[start:pos]); err != nil {
+				return nil, p.errorf(start, "invalid number %s", s[start:pos])
+			}
+		}
+		if obj, err = p.peel(obj, "commit", start-1); err != nil {
+			return nil, err
+		}
+		c := obj.(*Commit)
+		if op == '^' {
+			if n == 0 {
+				continue
+			}
+			if n > len(c.Parents) {
+				return nil, p.errorf(start-1, "commit %s has no parent %d", c.id, n)
+			}
+			obj, err = p.resolve(c.Parents[n-1], start-1)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		for ; n > 0; n-- {
+			if c.IsRoot() {
+				return nil, p.errorf(start-1, "commit %s has no parent", c.id)
+			}
+			if obj, err = p.resolve(c.Parents[0], start-1); err != nil {
+				return nil, err
+			}
+			c = obj.(*Commit)
+		}
+	}
+	return obj, nil
+}
+
+func matchingBrace(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// base resolves a revision without suffixes: an object id, a ref name, a
+// describe output or a ref with a @{...} specifier.
+func (p *revParser) base(s string) (Object, error) {
+	r := p.repo
+	if s == "" {
+		return nil, p.errorf(0, "empty revision")
+	}
+	if s == "@" {
+		s = "HEAD"
+	}
+	if strings.HasPrefix(s, "@{-") {
+		close := strings.IndexByte(s, '}')
+		if close == -1 {
+			return nil, p.errorf(2, "missing '}'")
+		}
+		n, err := strconv.Atoi(s[3:close])
+		if err != nil || n <= 0 {
+			return nil, p.errorf(3, "invalid number %s", s[3:close])
+		}
+		branch, err := r.previousBranch(n)
+		if err != nil {
+			return nil, p.errorf(0, "%v", err)
+		}
+		s = branch + s[close+1:]
+	}
+
+	at := strings.Index(s, "@{")
+	if at == -1 {
+		return p.lookup(s, 0)
+	}
+	if !strings.HasSuffix(s, "}") {
+		return nil, p.errorf(len(s), "missing '}'")
+	}
+	name, spec := s[:at], s[at+2:len(s)-1]
+
+	switch strings.ToLower(spec) {
+	case "u", "upstream":
+		branch, err := p.branchName(name, at)
+		if err != nil {
+			return nil, err
+		}
+		upstream, err := r.upstream(branch)
+		if err != nil {
+			return nil, p.errorf(at+2, "%v", err)
+		}
+		ref, err := r.Ref(upstream)
+		if err != nil {
+			return nil, p.errorf(at+2, "%v", err)
+		}
+		return p.object(ref.SHA1, at+2)
+	case "push":
+		return nil, p.errorf(at+2, "@{push} is not supported")
+	}
+
+	refName := ""
+	if name == "" {
+		head, err := r.derefName("HEAD")
+		if err != nil {
+			return nil, p.errorf(0, "%v", err)
+		}
+		refName = head
+	} else if refName, _ = r.dwimRef(name); refName == "" {
+		return nil, p.errorf(0, "unknown revision %s", name)
+	}
+	entries, err := r.Reflog(refName)
+	if err != nil {
+		return nil, p.errorf(0, "%v", err)
+	}
+	if len(entries) == 0 {
+		return nil, p.errorf(at, "log for %s is empty", refName)
+	}
+
+	if n, err := strconv.Atoi(spec); err == nil && n >= 0 {
+		switch {
+		case n < len(entries):
+			return p.object(entries[len(entries)-1-n].New, at)
+		case n == len(entries) && !entries[0].Old.IsZero():
+			return p.object(entries[0].Old, at)
+		}
+		return nil, p.errorf(at+2, "log for %s only has %d entries", refName, len(entries))
+	}
+	t, ok := parseApproxDate(spec, time.Now())
+	if !ok {
+		return nil, p.errorf(at+2, "invalid reflog specifier %s", spec)
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if !entries[i].Committer.Date.After(t) {
+			return p.object(entries[i].New, at)
+		}
+	}
+	// the log does not go back that far; use the oldest value known
+	if id := entries[0].Old; !id.IsZero() {
+		return p.object(id, at)
+	}
+	return p.object(entries[0].New, at)
+}
+
+// lookup resolves a full object id, a ref name, a describe output or an
+// abbreviated object id, in the order git tries them.
+func (p *revParser) lookup(name string, pos int) (Object, error) {
+	r := p.repo
+	if len(name) == r.Format.Size()*2 {
+		if id, err := NewSHA1(name); err == nil {
+			return p.object(id, pos)
+		}
+	}
+	if _, ref := r.dwimRef(name); ref != nil {
+		return p.object(ref.SHA1, pos)
+	}
+	short := name
+	if i := strings.LastIndex(name, "-g"); i > 0 && isHex(name[i+2:]) {
+		short = name[i+2:]
+	}
+	if isHex(short) && len(short) >= 4 {
+		id, err := r.expandObjectID(short)
+		if err == ErrAmbiguousObjectID {
+			return nil, p.errorf(pos, "short object id %s is ambiguous", short)
+		}
+		if err == nil {
+			return p.object(id, pos)
+		}
+	}
+	return nil, p.errorf(pos, "unknown revision %s", name)
+}
+
+func (p *revParser) object(id SHA1, pos int) (Object, error) {
+	obj, err := p.repo.Object(id)
+	if err != nil {
+		return nil, p.errorf(pos, "%s: %v", id, err)
+	}
+	return obj, nil
+}
+
+func (p *revParser) resolve(obj Object, pos int) (Object, error) {
+	if err := obj.Resolve(); err != nil {
+		return nil, p.errorf(pos, "%s: %v", obj.SHA1(), err)
+	}
+	return obj, nil
+}
+
+// branchName returns the branch name refers to, or the current branch if
+// name is empty.
+func (p *revParser) branchName(name string, pos int) (string, error) {
+	r := p.repo
+	refName := ""
+	if name == "" {
+		refName, _ = r.derefName("HEAD")
+	} else {
+		refName, _ = r.dwimRef(name)
+	}
+	if !strings.HasPrefix(refName, "refs/heads/") {
+		if name == "" {
+			return "", p.errorf(pos, "HEAD does not point to a branch")
+		}
+		return "", p.errorf(0, "%s is not a branch", name)
+	}
+	return strings.TrimPrefix(refName, "refs/heads/"), nil
+}
+
+// peelSpec handles the contents of ^{...}.
+func (p *revParser) peelSpec(obj Object, spec string, pos int) (Object, error) {
+	switch spec {
+	case "":
+		return p.peel(obj, "", pos)
+	case "object":
+		return p.resolve(obj, pos)
+	case "commit", "tree", "blob", "tag":
+		return p.peel(obj, spec, pos)
+	}
+	if strings.HasPrefix(spec, "/") {
+		commit, err := p.peel(obj, "commit", pos)
+		if err != nil {
+			return nil, err
+		}
+		return p.search([]*Commit{commit.(*Commit)}, spec[1:], pos+1)
+	}
+	return nil, p.errorf(pos, "unknown object type %s", spec)
+}
+
+// peel follows tags, and commits when a tree is wanted, until an object of
+// typ is found. An empty typ peels tags only.
+func (p *revParser) peel(obj Object, typ string, pos int) (Object, error) {
+	for {
+		if _, err := p.resolve(obj, pos); err != nil {
+			return nil, err
+		}
+		actual := objectType(obj)
+		if actual == typ || (typ == "" && actual != "tag") {
+			return obj, nil
+		}
+		switch o := obj.(type) {
+		case *Tag:
+			obj = o.Object
+			continue
+		case *Commit:
+			if typ == "tree" {
+				obj = o.Tree
+				continue
+			}
+		}
+		return nil, p.errorf(pos, "%s is a %s, not a %s", obj.SHA1(), actual, typ)
+	}
+}
+
+// search returns the youngest commit reachable from starts whose message
+// matches pattern. A leading "!-" negates the match and "!!" stands for a
+// literal "!".
+func (p *revParser) search(starts []*Commit, pattern string, pos int) (Object, error) {
+	negate := false
+	if strings.HasPrefix(pattern, "!") {
+		switch {
+		case strings.HasPrefix(pattern, "!-"):
+			negate, pattern = true, pattern[2:]
+		case strings.HasPrefix(pattern, "!!"):
+			pattern = pattern[1:]
+		default:
+			return nil, p.errorf(pos, "unknown modifier in %s", pattern)
+		}
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, p.errorf(pos, "%v", err)
+	}
+
+	var queue []*Commit
+	seen := make(map[SHA1]bool)
+	push := func(c *Commit) error {
+		if seen[c.id] {
+			return nil
+		}
+		seen[c.id] = true
+		if err := c.Resolve(); err != nil {
+			return err
+		}
+		queue = insertByDate(queue, c)
+		return nil
+	}
+	for _, c := range starts {
+		if err = push(c); err != nil {
+			return nil, p.errorf(pos, "%v", err)
+		}
+	}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		if re.Match(c.Data) != negate {
+			return c, nil
+		}
+		for _, parent := range c.Parents {
+			if err = push(parent); err != nil {
+				return nil, p.errorf(pos, "%v", err)
+			}
+		}
+	}
+	return nil, p.errorf(pos, "no commit message matches %s", pattern)
+}
+
+// allCommits returns the commits pointed to by HEAD and every ref.
+func (p *revParser) allCommits() ([]*Commit, error) {
+	r := p.repo
+	refs, err := r.matchingRefs("")
+	if err != nil {
+		return nil, err
+	}
+	if head, err := r.Head(); err == nil {
+		refs = append(refs, head)
+	}
+	var commits []*Commit
+	for _, ref := range refs {
+		obj, err := r.Object(ref.SHA1)
+		if err != nil {
+			continue
+		}
+		if obj, err = p.peel(obj, "commit", 0); err == nil {
+			commits = append(commits, obj.(*Commit))
+		}
+	}
+	return commits, nil
+}
+
+// commitOf returns the commit id points to, following tags.
+func (r *Repository) commitOf(id SHA1) (*Commit, error) {
+	p := &revParser{repo: r, rev: id.String()}
+	obj, err := p.object(id, 0)
+	if err != nil {
+		return nil, err
+	}
+	if obj, err = p.peel(obj, "commit", 0); err != nil {
+		return nil, err
+	}
+	return obj.(*Commit), nil
+}
+
+// dwimRef looks name up in the places of dwimRefRules and returns the full
+// name found with the ref it finally points to.
+func (r *Repository) dwimRef(name string) (string, *Ref) {
+	for _, rule := range dwimRefRules {
+		full := fmt.Sprintf(rule, name)
+		if ref, err := r.Ref(full); err == nil {
+			return full, ref
+		}
+	}
+	return "", nil
+}
+
+// previousBranch returns the branch, or the commit when HEAD was detached,
+// checked out n switches ago according to the reflog of HEAD.
+func (r *Repository) previousBranch(n int) (string, error) {
+	entries, err := r.Reflog("HEAD")
+	if err != nil {
+		return "", err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		msg := entries[i].Message
+		if !strings.HasPrefix(msg, "checkout: moving from ") {
+			continue
+		}
+		if n--; n == 0 {
+			msg = strings.TrimPrefix(msg, "checkout: moving from ")
+			if to := strings.LastIndex(msg, " to "); to != -1 {
+				return msg[:to], nil
+			}
+		}
+	}
+	return "", errors.New("Not enough branch switches in the reflog of HEAD")
+}
+
+// upstream returns the remote-tracking ref of branch from branch.<name>.remote
+// and branch.<name>.merge.
+func (r *Repository) upstream(branch string) (string, error) {
+	remote := r.config.Get("branch." + branch + ".remote")
+	merge := r.config.Get("branch." + branch + ".merge")
+	if remote == "" || merge == "" {
+		return "", fmt.Errorf("No upstream configured for branch %s", branch)
+	}
+	if remote == "." {
+		return merge, nil
+	}
+	for _, spec := range r.config.GetAll("remote." + remote + ".fetch") {
+		if dst, ok := mapRefspec(spec, merge); ok {
+			return dst, nil
+		}
+	}
+	return "", fmt.Errorf("Upstream branch %s not stored as a remote-tracking branch", merge)
+}
+
+// mapRefspec maps name from the source to the destination side of a fetch
+// refspec.
+func mapRefspec(spec, name string) (string, bool) {
+	spec = strings.TrimPrefix(spec, "+")
+	colon := strings.IndexByte(spec, ':')
+	if strings.HasPrefix(spec, "^") || colon == -1 {
+		return "", false
+	}
+	src, dst := spec[:colon], spec[colon+1:]
+	star := strings.IndexByte(src, '*')
+	if star == -1 {
+		return dst, src == name
+	}
+	prefix, suffix := src[:star], src[star+1:]
+	if len(name) < len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+	return strings.Replace(dst, "*", name[len(prefix):len(name)-len(suffix)], 1), true
+}
+
+// expandObjectID returns the only object whose id starts with the
+// hexadecimal prefix.
+func (r *Repository) expandObjectID(prefix string) (SHA1, error) {
+	prefix = strings.ToLower(prefix)
+	if !r.packsOpen {
+		if _, err := r.openPacks(); err != nil {
+			return SHA1{}, err
+		}
+	}
+	found := make(map[SHA1]bool)
+	for _, pack := range r.packs {
+		objs := pack.idx.Objects
+		i := sort.Search(len(objs), func(i int) bool { return objs[i].String() >= prefix })
+		for ; i < len(objs) && strings.HasPrefix(objs[i].String(), prefix); i++ {
+			found[objs[i]] = true
+		}
+	}
+	if len(prefix) >= 2 {
+		dir := filepath.Join(r.root, "objects", prefix[:2])
+		files, _ := ioutil.ReadDir(dir)
+		for _, file := range files {
+			if !strings.HasPrefix(file.Name(), prefix[2:]) {
+				continue
+			}
+			if id, err := NewSHA1(prefix[:2] + file.Name()); err == nil && id.Format() == r.Format {
+				found[id] = true
+			}
+		}
+	}
+	switch len(found) {
+	case 0:
+		return SHA1{}, ErrObjectNotFound
+	case 1:
+		for id := range found {
+			return id, nil
+		}
+	}
+	return SHA1{}, ErrAmbiguousObjectID
+}
+
+// abbrev returns the shortest prefix of id naming no other object like
+// git, with at least 7 digits and more for repositories with many packed
+// objects.
+func (r *Repository) abbrev(id SHA1) string {
+	if !r.packsOpen {
+		r.openPacks()
+	}
+	count := 0
+	for _, pack := range r.packs {
+		count += len(pack.idx.Objects)
+	}
+	bits := 0
+	for ; count > 0; count >>= 1 {
+		bits++
+	}
+	n := (bits + 1) / 2
+	if n < 7 {
+		n = 7
+	}
+	s := id.String()
+	if id == r.Format.zero() {
+		return s[:n]
+	}
+	for ; n < len(s); n++ {
+		if _, err := r.expandObjectID(s[:n]); err != ErrAmbiguousObjectID {
+			break
+		}
+	}
+	return s[:n]
+}
+
+func isHex(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func objectType(obj Object) string {
+	switch obj.(type) {
+	case *Blob:
+		return "blob"
+	case *Tree:
+		return "tree"
+	case *Commit:
+		return "commit"
+	case *Tag:
+		return "tag"
+	}
+	return ""
+}
+
+var approxDateUnits = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
+}
+
+// parseApproxDate understands the date forms most used in reflog
+// specifiers: "now", "yesterday", "<n> <unit>s ago" and absolute dates.
+func parseApproxDate(s string, now time.Time) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	switch strings.ToLower(s) {
+	case "now":
+		return now, true
+	case "yesterday":
+		return now.AddDate(0, 0, -1), true
+	}
+	if fields := strings.Fields(strings.Replace(strings.ToLower(s), ".", " ", -1)); len(fields) == 3 && fields[2] == "ago" {
+		n, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return now, false
+		}
+		unit := strings.TrimSuffix(fields[1], "s")
+		switch unit {
+		case "month":
+			return now.AddDate(0, -n, 0), true
+		case "year":
+			return now.AddDate(-n, 0, 0), true
+		}
+		if d, ok := approxDateUnits[unit]; ok {
+			return now.Add(-time.Duration(n) * d), true
+		}
+		return now, false
+	}
+	for _, layout := range []string{
+		time.RFC3339, time.RFC1123Z, "2006-01-02 15:04:05 -0700",
+		"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02",
+	} {
+		if t, err := time.ParseInLocation(layout, s, now.Location()); err == nil {
+			return t, true
+		}
+	}
+	return now, false
+}
@@ -0,0 +1,558 @@
+package git
+
+import (
+	"container/heap"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var ErrWalkStarted = errors.New("Walk already started")
+
+type RevSort int
+
+const (
+	// RevSortDefault shows commits in reverse chronological order as they
+	// are reached.
+	RevSortDefault RevSort = iota
+	// RevSortDate shows no parent before all of its children, and otherwise
+	// orders by commit date.
+	RevSortDate
+	// RevSortAuthorDate is RevSortDate ordered by author date.
+	RevSortAuthorDate
+	// RevSortTopo shows no parent before all of its children and avoids
+	// mixing commits of different lines of history.
+	RevSortTopo
+)
+
+// revSlop is the number of uninteresting commits walked after nothing
+// interesting is left, to cope with clock skew.
+const revSlop = 5
+
+const (
+	revQueued = 1 << iota
+	revAdded
+	revUninteresting
+)
+
+type RevWalkOptions struct {
+	Sort RevSort
+	// FirstParent follows only the first parent of merge commits.
+	FirstParent bool
+	NoMerges    bool
+	// MaxCount stops after that many commits. Zero means no limit.
+	MaxCount int
+	// Since and Until limit commit dates. Zero means no limit. Like git,
+	// the walk does not go further than a commit older than Since.
+	Since time.Time
+	Until time.Time
+	// Author, Committer and Grep show only commits whose author, committer
+	// ("Name <email>") or message matches.
+	Author    *regexp.Regexp
+	Committer *regexp.Regexp
+	Grep      *regexp.Regexp
+}
+
+// RevWalk iterates commits reachable from included commits but not from
+// excluded ones like git rev-list. Each commit is shown at most once.
+type RevWalk struct {
+	RevWalkOptions
+	repo        *Repository
+	nodes       map[SHA1]*revNode
+	queue       *commitQueue
+	interesting int
+	excludes    bool
+	started     bool
+	out         []*Commit
+	count       int
+}
+
+type revNode struct {
+	commit *Commit
+	flags  int
+}
+
+func (r *Repository) RevWalk(opts RevWalkOptions) *RevWalk {
+	return &RevWalk{
+		RevWalkOptions: opts,
+		repo:           r,
+		nodes:          make(map[SHA1]*revNode),
+		queue:          newCommitQueue(commitDate),
+	}
+}
+
+// Push adds the start points of rev, which is either a revision, "^X" to
+// exclude X, "A..B", "A...B", "X^@" for the parents of X or "X^!" for X
+// without its parents. A missing side of a range means HEAD.
+func (w *RevWalk) Push(rev string) error {
+	if i := strings.Index(rev, "..."); i != -1 {
+		a, err := w.revCommit(rev[:i], "HEAD")
+		if err != nil {
+			return err
+		}
+		b, err := w.revCommit(rev[i+3:], "HEAD")
+		if err != nil {
+			return err
+		}
+		bases, err := w.repo.paintDownToCommon(a, []*Commit{b})
+		if err != nil {
+			return err
+		}
+		for _, c := range bases {
+			if err = w.add(c, true); err != nil {
+				return err
+			}
+		}
+		if err = w.add(a, false); err != nil {
+			return err
+		}
+		return w.add(b, false)
+	}
+	if i := strings.Index(rev, ".."); i != -1 {
+		a, err := w.revCommit(rev[:i], "HEAD")
+		if err != nil {
+			return err
+		}
+		b, err := w.revCommit(rev[i+2:], "HEAD")
+		if err != nil {
+			return err
+		}
+		if err = w.add(a, true); err != nil {
+			return err
+		}
+		return w.add(b, false)
+	}
+	if strings.HasSuffix(rev, "^@") || strings.HasSuffix(rev, "^!") {
+		c, err := w.revCommit(rev[:len(rev)-2], "")
+		if err != nil {
+			return err
+		}
+		parentsOnly := strings.HasSuffix(rev, "^@")
+		if !parentsOnly {
+			if err = w.add(c, false); err != nil {
+				return err
+			}
+		}
+		for _, p := range c.Parents {
+			if err = w.add(p, !parentsOnly); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if strings.HasPrefix(rev, "^") {
+		c, err := w.revCommit(rev[1:], "")
+		if err != nil {
+			return err
+		}
+		return w.add(c, true)
+	}
+	c, err := w.revCommit(rev, "")
+	if err != nil {
+		return err
+	}
+	return w.add(c, false)
+}
+
+// Include adds the commit id, or the commit a tag points to, as a start
+// point.
+func (w *RevWalk) Include(id SHA1) error {
+	c, err := w.repo.commitOf(id)
+	if err != nil {
+		return err
+	}
+	return w.add(c, false)
+}
+
+// Exclude hides the commit id and all its ancestors.
+func (w *RevWalk) Exclude(id SHA1) error {
+	c, err := w.repo.commitOf(id)
+	if err != nil {
+		return err
+	}
+	return w.add(c, true)
+}
+
+func (w *RevWalk) revCommit(rev, def string) (*Commit, error) {
+	if rev == "" {
+		rev = def
+	}
+	p := &revParser{repo: w.repo, rev: rev}
+	obj, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	if obj, err = p.peel(obj, "commit", 0); err != nil {
+		return nil, err
+	}
+	return obj.(*Commit), nil
+}
+
+func (w *RevWalk) add(c *Commit, uninteresting bool) error {
+	if w.started {
+		return ErrWalkStarted
+	}
+	n, err := w.node(c)
+	if err != nil {
+		return err
+	}
+	if uninteresting {
+		w.excludes = true
+		w.markUninteresting(n)
+	}
+	w.push(n)
+	return nil
+}
+
+// node returns the node shared by every instance of the commit.
+func (w *RevWalk) node(c *Commit) (*revNode, error) {
+	if n, ok := w.nodes[c.id]; ok {
+		return n, nil
+	}
+	if err := c.Resolve(); err != nil {
+		return nil, err
+	}
+	n := &revNode{commit: c}
+	w.nodes[c.id] = n
+	return n, nil
+}
+
+func (w *RevWalk) push(n *revNode) {
+	if n.flags&revQueued != 0 {
+		return
+	}
+	n.flags |= revQueued
+	if n.flags&revUninteresting == 0 {
+		w.interesting++
+	}
+	w.queue.push(n.commit)
+}
+
+func (w *RevWalk) pop() *revNode {
+	n := w.nodes[w.queue.pop().id]
+	if n.flags&revUninteresting == 0 {
+		w.interesting--
+	}
+	return n
+}
+
+// markUninteresting marks n and the ancestors already walked from it.
+func (w *RevWalk) markUninteresting(n *revNode) {
+	stack := []*revNode{n}
+	for len(stack) > 0 {
+		n = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if n.flags&revUninteresting != 0 {
+			continue
+		}
+		n.flags |= revUninteresting
+		if n.flags&revQueued != 0 && w.queue.contains(n.commit) {
+			w.interesting--
+		}
+		if n.flags&revAdded == 0 {
+			continue
+		}
+		for _, p := range n.commit.Parents {
+			if pn, ok := w.nodes[p.id]; ok {
+				stack = append(stack, pn)
+			}
+		}
+	}
+}
+
+// addParents queues the parents of n. Every parent of an uninteresting
+// commit is uninteresting too.
+func (w *RevWalk) addParents(n *revNode) error {
+	if n.flags&revAdded != 0 {
+		return nil
+	}
+	n.flags |= revAdded
+	uninteresting := n.flags&revUninteresting != 0
+	for _, p := range n.commit.Parents {
+		pn, err := w.node(p)
+		if err != nil {
+			return err
+		}
+		if uninteresting {
+			w.markUninteresting(pn)
+		}
+		w.push(pn)
+		if w.FirstParent && !uninteresting {
+			break
+		}
+	}
+	return nil
+}
+
+func (w *RevWalk) limited() bool {
+	return w.excludes || w.Sort != RevSortDefault
+}
+
+// limit walks the whole range up front, which excluded commits and the
+// topological orders require.
+func (w *RevWalk) limit() error {
+	var list []*revNode
+	slop := revSlop
+	for w.queue.Len() > 0 {
+		n := w.pop()
+		if !w.Since.IsZero() && n.commit.Committer.Date.Before(w.Since) {
+			w.markUninteresting(n)
+		}
+		if err := w.addParents(n); err != nil {
+			return err
+		}
+		if n.flags&revUninteresting != 0 {
+			if w.interesting > 0 {
+				slop = revSlop
+			} else if slop--; slop == 0 {
+				break
+			}
+			continue
+		}
+		list = append(list, n)
+	}
+
+	var kept []*revNode
+	for _, n := range list {
+		if n.flags&revUninteresting == 0 {
+			kept = append(kept, n)
+		}
+	}
+	switch w.Sort {
+	case RevSortDate:
+		kept = w.sortTopo(kept, commitDate)
+	case RevSortAuthorDate:
+		kept = w.sortTopo(kept, authorDate)
+	case RevSortTopo:
+		kept = w.sortTopo(kept, nil)
+	}
+	for _, n := range kept {
+		w.out = append(w.out, n.commit)
+	}
+	return nil
+}
+
+// sortTopo orders list so that children come before their parents, taking
+// the most recent commit by date among the candidates. A nil date takes the
+// one queued last so that a line of history is shown in a row.
+func (w *RevWalk) sortTopo(list []*revNode, date func(*Commit) time.Time) []*revNode {
+	indegree := make(map[*revNode]int, len(list))
+	for _, n := range list {
+		indegree[n] = 1
+	}
+	parents := func(n *revNode) []*revNode {
+		var ps []*revNode
+		for _, p := range n.commit.Parents {
+			if pn, ok := w.nodes[p.id]; ok && indegree[pn] > 0 {
+				ps = append(ps, pn)
+			}
+			if w.FirstParent {
+				break
+			}
+		}
+		return ps
+	}
+	for _, n := range list {
+		for _, p := range parents(n) {
+			indegree[p]++
+		}
+	}
+
+	var (
+		stack []*revNode
+		queue = newCommitQueue(date)
+		out   []*revNode
+	)
+	ready := func(n *revNode) {
+		if date == nil {
+			stack = append(stack, n)
+		} else {
+			queue.push(n.commit)
+		}
+	}
+	var tips []*revNode
+	for _, n := range list {
+		if indegree[n] == 1 {
+			tips = append(tips, n)
+		}
+	}
+	if date == nil {
+		for i := len(tips) - 1; i >= 0; i-- {
+			ready(tips[i])
+		}
+	} else {
+		for _, n := range tips {
+			ready(n)
+		}
+	}
+	for len(stack) > 0 || queue.Len() > 0 {
+		var n *revNode
+		if date == nil {
+			n = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+		} else {
+			n = w.nodes[queue.pop().id]
+		}
+		out = append(out, n)
+		for _, p := range parents(n) {
+			if indegree[p]--; indegree[p] == 1 {
+				ready(p)
+			}
+		}
+	}
+	return out
+}
+
+// Next returns the next commit of the walk, or io.EOF at the end.
+func (w *RevWalk) Next() (*Commit, error) {
+	if !w.started {
+		w.started = true
+		if w.limited() {
+			if err := w.limit(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for {
+		if w.MaxCount > 0 && w.count >= w.MaxCount {
+			return nil, io.EOF
+		}
+		c, err := w.next()
+		if err != nil {
+			return nil, err
+		}
+		if w.show(c) {
+			w.count++
+			return c, nil
+		}
+	}
+}
+
+func (w *RevWalk) next() (*Commit, error) {
+	if w.limited() {
+		if len(w.out) == 0 {
+			return nil, io.EOF
+		}
+		c := w.out[0]
+		w.out = w.out[1:]
+		return c, nil
+	}
+	for w.queue.Len() > 0 {
+		n := w.pop()
+		if !w.Since.IsZero() && n.commit.Committer.Date.Before(w.Since) {
+			continue
+		}
+		if err := w.addParents(n); err != nil {
+			return nil, err
+		}
+		return n.commit, nil
+	}
+	return nil, io.EOF
+}
+
+func (w *RevWalk) show(c *Commit) bool {
+	if w.NoMerges && len(c.Parents) > 1 {
+		return false
+	}
+	if !w.Until.IsZero() && c.Committer.Date.After(w.Until) {
+		return false
+	}
+	if w.Author != nil && !w.Author.MatchString(c.Author.Name+" <"+c.Author.Email+">") {
+		return false
+	}
+	if w.Committer != nil && !w.Committer.MatchString(c.Committer.Name+" <"+c.Committer.Email+">") {
+		return false
+	}
+	if w.Grep != nil && !w.Grep.Match(c.Data) {
+		return false
+	}
+	return true
+}
+
+// ForEach calls fn for every remaining commit of the walk.
+func (w *RevWalk) ForEach(fn func(*Commit) error) error {
+	for {
+		c, err := w.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err = fn(c); err != nil {
+			return err
+		}
+	}
+}
+
+func commitDate(c *Commit) time.Time {
+	return c.Committer.Date
+}
+
+func authorDate(c *Commit) time.Time {
+	return c.Author.Date
+}
+
+// commitQueue pops the most recent commit first, and commits of the same
+// date in the order they were pushed. With gen, commits of higher
+// generation are popped first regardless of their dates.
+type commitQueue struct {
+	items []commitQueueItem
+	date  func(*Commit) time.Time
+	gen   func(*Commit) uint32
+	seq   int
+	ids   map[SHA1]int
+}
+
+type commitQueueItem struct {
+	commit *Commit
+	seq    int
+}
+
+func newCommitQueue(date func(*Commit) time.Time) *commitQueue {
+	return &commitQueue{date: date, ids: make(map[SHA1]int)}
+}
+
+func (q *commitQueue) Len() int { return len(q.items) }
+
+func (q *commitQueue) Less(i, j int) bool {
+	if q.gen != nil {
+		if a, b := q.gen(q.items[i].commit), q.gen(q.items[j].commit); a != b {
+			return a > b
+		}
+	}
+	a, b := q.date(q.items[i].commit), q.date(q.items[j].commit)
+	if !a.Equal(b) {
+		return a.After(b)
+	}
+	return q.items[i].seq < q.items[j].seq
+}
+
+func (q *commitQueue) Swap(i, j int) { q.items[i], q.items[j] = q.items[j], q.items[i] }
+
+func (q *commitQueue) Push(x interface{}) { q.items = append(q.items, x.(commitQueueItem)) }
+
+func (q *commitQueue) Pop() interface{} {
+	item := q.items[len(q.items)-1]
+	q.items = q.items[:len(q.items)-1]
+	return item
+}
+
+func (q *commitQueue) push(c *Commit) {
+	heap.Push(q, commitQueueItem{commit: c, seq: q.seq})
+	q.seq++
+	q.ids[c.id]++
+}
+
+func (q *commitQueue) pop() *Commit {
+	c := heap.Pop(q).(commitQueueItem).commit
+	if q.ids[c.id]--; q.ids[c.id] == 0 {
+		delete(q.ids, c.id)
+	}
+	return c
+}
+
+func (q *commitQueue) contains(c *Commit) bool {
+	return q.ids[c.id] > 0
+}
@@ -2,27 +2,108 @@ package git
 
 import (
 	"bytes"
-	"encoding/binary"
+	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"hash"
 	"io"
+
+	"github.com/pjbgf/sha1cd"
+)
+
+var ErrInvalidObjectID = errors.New("Invalid object id")
+
+type ObjectFormat int
+
+const (
+	FormatSHA1 ObjectFormat = iota
+	FormatSHA256
 )
 
-type SHA1 [20]byte
+const maxHashSize = sha256.Size
+
+func (f ObjectFormat) Size() int {
+	if f == FormatSHA256 {
+		return sha256.Size
+	}
+	return sha1.Size
+}
+
+func (f ObjectFormat) String() string {
+	if f == FormatSHA256 {
+		return "sha256"
+	}
+	return "sha1"
+}
+
+func (f ObjectFormat) newHash() hash.Hash {
+	if f == FormatSHA256 {
+		return sha256.New()
+	}
+	return sha1cd.New()
+}
+
+func (f ObjectFormat) zero() SHA1 {
+	return SHA1{size: uint8(f.Size())}
+}
+
+func formatForSize(size int) (ObjectFormat, bool) {
+	switch size {
+	case sha1.Size:
+		return FormatSHA1, true
+	case sha256.Size:
+		return FormatSHA256, true
+	}
+	return FormatSHA1, false
+}
+
+// SHA1 is an object id. Despite the name, it holds either a SHA-1 or a
+// SHA-256 hash depending on the object format of the repository.
+type SHA1 struct {
+	hash [maxHashSize]byte
+	size uint8
+}
 
 func (b SHA1) String() string {
-	return hex.EncodeToString(b[:])
+	return hex.EncodeToString(b.Bytes())
+}
+
+func (b SHA1) Bytes() []byte {
+	return b.hash[:b.size]
+}
+
+func (b SHA1) Format() ObjectFormat {
+	f, _ := formatForSize(int(b.size))
+	return f
+}
+
+func (b SHA1) IsZero() bool {
+	return b == SHA1{size: b.size}
 }
 
 func (b SHA1) Compare(other SHA1) int {
-	return bytes.Compare(b[:], other[:])
+	return bytes.Compare(b.Bytes(), other.Bytes())
+}
+
+func (b SHA1) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+func (b *SHA1) UnmarshalText(text []byte) (err error) {
+	*b, err = NewSHA1(string(text))
+	return
 }
 
 func NewSHA1(s string) (sha SHA1, err error) {
 	var b []byte
-	if b, err = hex.DecodeString(s); err == nil {
-		copy(sha[:], b)
+	if b, err = hex.DecodeString(s); err != nil {
+		return
 	}
-	return
+	if _, ok := formatForSize(len(b)); !ok {
+		return sha, ErrInvalidObjectID
+	}
+	return sha1FromBytes(b), nil
 }
 
 func SHA1FromString(s string) SHA1 {
@@ -33,7 +114,13 @@ func SHA1FromString(s string) SHA1 {
 	return sha
 }
 
-func readSHA1(r io.Reader) (sha SHA1, err error) {
-	err = binary.Read(r, binary.BigEndian, &sha)
+func sha1FromBytes(b []byte) (sha SHA1) {
+	sha.size = uint8(copy(sha.hash[:], b))
+	return
+}
+
+func readSHA1(r io.Reader, format ObjectFormat) (sha SHA1, err error) {
+	sha = format.zero()
+	_, err = io.ReadFull(r, sha.hash[:sha.size])
 	return
 }
@@ -0,0 +1,391 @@
+package git
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// FileStat is the number of lines added to and deleted from a file by a
+// change, like a line of git diff --numstat. For a binary file, Binary is
+// set and the sizes of the old and new contents are given instead when
+// they differ.
+type FileStat struct {
+	Change  *Change
+	Added   int
+	Deleted int
+	Binary  bool
+	OldSize int64
+	NewSize int64
+}
+
+type StatOptions struct {
+	Algorithm DiffAlgorithm
+	// MaxSize treats files larger than it as binary without reading them,
+	// like core.bigFileThreshold of git. There is no limit if zero.
+	MaxSize int64
+}
+
+// DiffStat counts the lines added and deleted by each of the changes,
+// reading the contents of the files from r.
+func (r *Repository) DiffStat(changes []*Change, opts StatOptions) ([]*FileStat, error) {
+	stats := make([]*FileStat, 0, len(changes))
+	for _, c := range changes {
+		s, err := r.fileStat(c, opts)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+// CommitStats counts the lines changed by a commit against each of its
+// parents in order, or against an empty tree for a root commit.
+func (r *Repository) CommitStats(c *Commit, diff DiffOptions, opts StatOptions) ([][]*FileStat, error) {
+	if err := r.Resolve(c); err != nil {
+		return nil, err
+	}
+	if c.IsRoot() {
+		stats, err := r.treeStat(nil, c.Tree, diff, opts)
+		if err != nil {
+			return nil, err
+		}
+		return [][]*FileStat{stats}, nil
+	}
+	var all [][]*FileStat
+	for _, p := range c.Parents {
+		if err := r.Resolve(p); err != nil {
+			return nil, err
+		}
+		stats, err := r.treeStat(p.Tree, c.Tree, diff, opts)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, stats)
+	}
+	return all, nil
+}
+
+func (r *Repository) treeStat(a, b *Tree, diff DiffOptions, opts StatOptions) ([]*FileStat, error) {
+	changes, err := DiffTrees(a, b, diff)
+	if err != nil {
+		return nil, err
+	}
+	return r.DiffStat(changes, opts)
+}
+
+func (r *Repository) fileStat(c *Change, opts StatOptions) (*FileStat, error) {
+	s := &FileStat{Change: c}
+	old := &statSide{mode: c.OldMode, id: c.OldID}
+	new := &statSide{mode: c.NewMode, id: c.NewID}
+	same := c.OldID == c.NewID
+	for _, side := range []*statSide{old, new} {
+		binary, err := r.statBinary(side, opts.MaxSize)
+		if err != nil {
+			return nil, err
+		}
+		if binary {
+			s.Binary = true
+			break
+		}
+	}
+	switch {
+	case s.Binary:
+		if same {
+			break
+		}
+		var err error
+		if s.OldSize, err = r.statSize(old); err != nil {
+			return nil, err
+		}
+		if s.NewSize, err = r.statSize(new); err != nil {
+			return nil, err
+		}
+	case !same:
+		for _, side := range []*statSide{old, new} {
+			if err := r.statRead(side); err != nil {
+				return nil, err
+			}
+		}
+		for _, lc := range newLineDiff(old.data, new.data, opts.Algorithm).changes() {
+			s.Added += lc.NewLines
+			s.Deleted += lc.OldLines
+		}
+	}
+	return s, nil
+}
+
+// statSide is a side of a change whose contents are read on demand.
+type statSide struct {
+	mode int
+	id   SHA1
+	data []byte
+	read bool
+	size int64
+}
+
+func (r *Repository) statRead(s *statSide) error {
+	if s.read {
+		return nil
+	}
+	data, err := r.patchContents(s.mode, s.id)
+	if err != nil {
+		return err
+	}
+	s.data, s.size, s.read = data, int64(len(data)), true
+	return nil
+}
+
+// statBinary reports whether a side looks binary, which a blob larger
+// than maxSize does without being read.
+func (r *Repository) statBinary(s *statSide, maxSize int64) (bool, error) {
+	if maxSize > 0 && s.mode != 0 && s.mode&0170000 != 0160000 {
+		size, err := r.objectSize(s.id)
+		if err != nil {
+			return false, err
+		}
+		if size > maxSize {
+			s.size = size
+			return true, nil
+		}
+	}
+	if err := r.statRead(s); err != nil {
+		return false, err
+	}
+	return isBinary(s.data), nil
+}
+
+func (r *Repository) statSize(s *statSide) (int64, error) {
+	switch {
+	case s.read || s.size > 0:
+		return s.size, nil
+	case s.mode == 0:
+		return 0, nil
+	case s.mode&0170000 == 0160000:
+		if err := r.statRead(s); err != nil {
+			return 0, err
+		}
+		return s.size, nil
+	}
+	return r.objectSize(s.id)
+}
+
+// Name returns the path of the file as git diff --stat shows it, with the
+// part of a renamed or copied path which changed in the form {old => new}.
+func (s *FileStat) Name() string {
+	c := s.Change
+	if c.Type != ChangeRename && c.Type != ChangeCopy || c.OldPath == c.NewPath {
+		return quotePath(c.NewPath)
+	}
+	a, b := c.OldPath, c.NewPath
+	if needsQuote(a) || needsQuote(b) {
+		return quotePath(a) + " => " + quotePath(b)
+	}
+
+	// the common prefix ends with a slash, and so does the common suffix
+	// start unless it is empty
+	pfx := 0
+	for i := 0; i < len(a) && i < len(b) && a[i] == b[i]; i++ {
+		if a[i] == '/' {
+			pfx = i + 1
+		}
+	}
+	sfx := 0
+	adjust := 0
+	if pfx > 0 {
+		adjust = 1
+	}
+	for i, j := len(a), len(b); i >= pfx-adjust && j >= pfx-adjust && byteAt(a, i) == byteAt(b, j); i, j = i-1, j-1 {
+		if byteAt(a, i) == '/' {
+			sfx = len(a) - i
+		}
+	}
+	amid, bmid := len(a)-pfx-sfx, len(b)-pfx-sfx
+	if amid < 0 {
+		amid = 0
+	}
+	if bmid < 0 {
+		bmid = 0
+	}
+	if pfx+sfx == 0 {
+		return a + " => " + b
+	}
+	return a[:pfx] + "{" + a[pfx:pfx+amid] + " => " + b[pfx:pfx+bmid] + "}" + a[len(a)-sfx:]
+}
+
+// byteAt returns s[i], or 0 past the end of s like the NUL of a C string.
+func byteAt(s string, i int) byte {
+	if i < len(s) {
+		return s[i]
+	}
+	return 0
+}
+
+// WriteNumstat writes the stats like git diff --numstat, with dashes for
+// the counts of binary files.
+func WriteNumstat(w io.Writer, stats []*FileStat) error {
+	bw := bufio.NewWriter(w)
+	for _, s := range stats {
+		if s.Binary {
+			fmt.Fprintf(bw, "-\t-\t%s\n", s.Name())
+		} else {
+			fmt.Fprintf(bw, "%d\t%d\t%s\n", s.Added, s.Deleted, s.Name())
+		}
+	}
+	return bw.Flush()
+}
+
+// WriteStat writes the stats like git diff --stat in width columns, 80 if
+// zero, followed by a summary line. Long names are cut from the left and
+// the graphs are scaled to fit.
+func WriteStat(w io.Writer, stats []*FileStat, width int) error {
+	if len(stats) == 0 {
+		return nil
+	}
+	if width <= 0 {
+		width = 80
+	}
+	maxLen, maxChange, numberWidth, binWidth := 0, 0, 0, 0
+	for _, s := range stats {
+		if n := len(s.Name()); n > maxLen {
+			maxLen = n
+		}
+		if s.Binary {
+			if n := 14 + decimalWidth(s.OldSize) + decimalWidth(s.NewSize); n > binWidth {
+				binWidth = n
+			}
+			numberWidth = 3
+			continue
+		}
+		if n := s.Added + s.Deleted; n > maxChange {
+			maxChange = n
+		}
+	}
+	if n := decimalWidth(int64(maxChange)); n > numberWidth {
+		numberWidth = n
+	}
+	if width < 16+6+numberWidth {
+		width = 16 + 6 + numberWidth
+	}
+
+	// the name and the graph get what they want unless it is too wide,
+	// when the graph is given at most 3/8 of the width
+	graphWidth := maxChange
+	if maxChange+4 <= binWidth {
+		graphWidth = binWidth - 4
+	}
+	nameWidth := maxLen
+	if nameWidth+numberWidth+6+graphWidth > width {
+		if graphWidth > width*3/8-numberWidth-6 {
+			graphWidth = width*3/8 - numberWidth - 6
+			if graphWidth < 6 {
+				graphWidth = 6
+			}
+		}
+		if nameWidth > width-numberWidth-6-graphWidth {
+			nameWidth = width - numberWidth - 6 - graphWidth
+		} else {
+			graphWidth = width - numberWidth - 6 - nameWidth
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	var adds, dels int
+	for _, s := range stats {
+		name, prefix := s.Name(), ""
+		n := nameWidth
+		if len(name) > n {
+			prefix = "..."
+			if n -= 3; n < 0 {
+				n = 0
+			}
+			name = name[len(name)-n:]
+			for i := 0; i < len(name); i++ {
+				if name[i] == '/' {
+					name = name[i:]
+					break
+				}
+			}
+		}
+		padding := n - len(name)
+		if padding < 0 {
+			padding = 0
+		}
+		fmt.Fprintf(bw, " %s%s%*s | ", prefix, name, padding, "")
+
+		if s.Binary {
+			fmt.Fprintf(bw, "%*s", numberWidth, "Bin")
+			if s.OldSize != 0 || s.NewSize != 0 {
+				fmt.Fprintf(bw, " %d -> %d bytes", s.OldSize, s.NewSize)
+			}
+			bw.WriteByte('\n')
+			continue
+		}
+		adds += s.Added
+		dels += s.Deleted
+
+		add, del := s.Added, s.Deleted
+		if graphWidth <= maxChange {
+			total := scaleLinear(add+del, graphWidth, maxChange)
+			if total < 2 && add > 0 && del > 0 {
+				total = 2
+			}
+			if add < del {
+				add = scaleLinear(add, graphWidth, maxChange)
+				del = total - add
+			} else {
+				del = scaleLinear(del, graphWidth, maxChange)
+				add = total - del
+			}
+		}
+		fmt.Fprintf(bw, "%*d", numberWidth, s.Added+s.Deleted)
+		if s.Added+s.Deleted > 0 {
+			bw.WriteByte(' ')
+		}
+		for i := 0; i < add; i++ {
+			bw.WriteByte('+')
+		}
+		for i := 0; i < del; i++ {
+			bw.WriteByte('-')
+		}
+		bw.WriteByte('\n')
+	}
+	bw.WriteString(statSummary(len(stats), adds, dels))
+	return bw.Flush()
+}
+
+// statSummary returns the last line of git diff --stat, which omits the
+// insertions or the deletions when there are none of them but some of the
+// other.
+func statSummary(files, adds, dels int) string {
+	s := fmt.Sprintf(" %d %s changed", files, plural(files, "file", "files"))
+	if adds > 0 || dels == 0 {
+		s += fmt.Sprintf(", %d %s(+)", adds, plural(adds, "insertion", "insertions"))
+	}
+	if dels > 0 || adds == 0 {
+		s += fmt.Sprintf(", %d %s(-)", dels, plural(dels, "deletion", "deletions"))
+	}
+	return s + "\n"
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
+
+// scaleLinear scales n of max into width columns, giving at least one
+// column to any change.
+func scaleLinear(n, width, max int) int {
+	if n == 0 {
+		return 0
+	}
+	return 1 + n*(width-1)/max
+}
+
+func decimalWidth(n int64) int {
+	return len(strconv.FormatInt(n, 10))
+}
@@ -36,7 +36,15 @@ func (t *Tag) Parse(data []byte) error {
 		return err
 	}
 
-	obj := newObject(string(kv["type"]), SHA1FromString(string(kv["object"])), t.repo)
+	typ := string(kv["type"])
+	if !validObjectType(typ) {
+		return ErrUnknownFormat
+	}
+	id, err := NewSHA1(string(kv["object"]))
+	if err != nil {
+		return err
+	}
+	obj := newObject(typ, id, t.repo)
 	tagger, err := newUser(kv["tagger"])
 	if err != nil {
 		return err
@@ -44,7 +52,9 @@ func (t *Tag) Parse(data []byte) error {
 	t.Object = obj
 	t.Tagger = tagger
 	t.Name = string(kv["tag"])
-	t.Data = data[1:]
+	if len(data) > 0 {
+		t.Data = data[1:]
+	}
 	return nil
 }
 
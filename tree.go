@@ -1,9 +1,7 @@
 package git
 
 import (
-	"bufio"
 	"bytes"
-	"io"
 	"strconv"
 	"strings"
 )
@@ -26,42 +24,57 @@ func (t *Tree) SHA1() SHA1 {
 }
 
 func (t *Tree) Parse(data []byte) error {
-	br := bufio.NewReader(bytes.NewReader(data))
-	for {
-		bs, err := br.ReadBytes(' ')
-		if err != nil {
-			if err == io.EOF {
-				return nil
-			}
-			return ErrUnknownFormat
-		}
-		mode, err := strconv.ParseInt(string(bs[:len(bs)-1]), 8, 32)
+	entries := []*TreeEntry{}
+	err := scanTree(data, t.repo.Format, func(mode, name []byte, id SHA1) error {
+		m, err := strconv.ParseInt(string(mode), 8, 32)
 		if err != nil {
 			return err
 		}
+		entries = append(entries, &TreeEntry{
+			Mode:   int(m),
+			Name:   string(name),
+			Object: newObject(modeType(int(m)), id, t.repo),
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	t.Entries = entries
+	return nil
+}
 
-		name, err := br.ReadBytes(0)
-		if err != nil {
+func scanTree(data []byte, format ObjectFormat, fn func(mode, name []byte, id SHA1) error) error {
+	size := format.Size()
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		if sp == -1 {
 			return ErrUnknownFormat
 		}
-		id, err := readSHA1(br)
-		if err != nil {
+		nul := bytes.IndexByte(data[sp+1:], 0)
+		if nul == -1 || len(data) < sp+1+nul+1+size {
 			return ErrUnknownFormat
 		}
-
-		obj, err := t.repo.readObject(id, nil, true)
-		if err != nil {
+		nul += sp + 1
+		id := sha1FromBytes(data[nul+1 : nul+1+size])
+		if err := fn(data[:sp], data[sp+1:nul], id); err != nil {
 			return err
 		}
-		t.Entries = append(t.Entries, &TreeEntry{
-			Mode:   int(mode),
-			Name:   string(name[:len(name)-1]),
-			Object: obj,
-		})
+		data = data[nul+1+size:]
 	}
 	return nil
 }
 
+func modeType(mode int) string {
+	switch mode & 0170000 {
+	case 0040000:
+		return "tree"
+	case 0160000:
+		return "commit"
+	}
+	return "blob"
+}
+
 func (t *Tree) Resolve() error {
 	return t.repo.Resolve(t)
 }
@@ -76,17 +89,25 @@ func (t *Tree) Find(path string) (Object, error) {
 }
 
 func (t *Tree) find(items []string) (Object, error) {
+	e, err := t.entry(items)
+	if err != nil {
+		return nil, err
+	}
+	err = t.repo.Resolve(e.Object)
+	return e.Object, err
+}
+
+func (t *Tree) entry(items []string) (*TreeEntry, error) {
 	if err := t.repo.Resolve(t); err != nil {
 		return nil, err
 	}
 	for _, e := range t.Entries {
 		if e.Name == items[0] {
 			if len(items) == 1 {
-				err := t.repo.Resolve(e.Object)
-				return e.Object, err
+				return e, nil
 			}
 			if tree, ok := e.Object.(*Tree); ok {
-				return tree.find(items[1:])
+				return tree.entry(items[1:])
 			}
 			break
 		}
@@ -3,6 +3,7 @@ package git
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"strconv"
 	"time"
 )
@@ -23,14 +24,14 @@ func newUser(data []byte) (*User, error) {
 	if pos = bytes.IndexByte(data, '<'); pos == -1 {
 		return nil, ErrUnknownFormat
 	}
-	user.Name = string(data[:pos-1])
+	user.Name = string(bytes.TrimRight(data[:pos], " "))
 	data = data[pos+1:]
 
 	if pos = bytes.IndexByte(data, '>'); pos == -1 {
 		return nil, ErrUnknownFormat
 	}
 	user.Email = string(data[:pos])
-	data = data[pos+2:]
+	data = bytes.TrimLeft(data[pos+1:], " ")
 
 	if pos = bytes.IndexByte(data, ' '); pos == -1 {
 		return nil, ErrUnknownFormat
@@ -46,3 +47,9 @@ func newUser(data []byte) (*User, error) {
 	user.Date = time.Unix(sec, 0).In(t.Location())
 	return &user, nil
 }
+
+// String formats the user the way git writes identities in objects and
+// reflogs, e.g. "Name <email> 1234567890 +0900".
+func (u *User) String() string {
+	return fmt.Sprintf("%s <%s> %d %s", u.Name, u.Email, u.Date.Unix(), u.Date.Format("-0700"))
+}